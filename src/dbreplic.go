@@ -2,13 +2,19 @@ package main
 
 import (
     "github.com/jasonlvhit/gocron"
+    "./dbreplic"
     "./myutil"
+    "./myconf"
     "./mydb"
     "./mynodb"
     "os"
-    "github.com/BurntSushi/toml"
     _ "github.com/go-sql-driver/mysql"
     "fmt"
+    "context"
+    "bufio"
+    "strconv"
+    "strings"
+    "time"
 )
 
 /*
@@ -29,40 +35,314 @@ DESCRIBE cats;
 ALTER TABLE `cats` ADD COLUMN `sys_sync_id` INT AUTO_INCREMENT UNIQUE;
 ALTER TABLE `cats` ADD COLUMN `sys_sync_update_time`  TIMESTAMP ON UPDATE CURRENT_TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
 ALTER TABLE `cats` ADD COLUMN `sys_sync_create_time`  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+dbreplic prepare检查并增加这些列(sys_sync_id为BIGINT, 时间列为TIMESTAMP(6))和sys_sync_update_time上的索引
+6) 增量复制
+有sys_sync_id和sys_sync_update_time列的表, 按(sys_sync_update_time, sys_sync_id)复制水位之后修改的行到dbTo, 见src/dbreplic
+7) 初始复制
+没有水位的表先在dbTo中创建(如果没有), 按sys_sync_id分批复制所有行, 然后从复制开始的时间继续增量复制
+8) 选择表
+tables按顺序匹配包含(+)和排除(-)的glob或正则表达式, excludeTables相当于最前面的排除规则, 每次运行重新读取表
+9) binlog复制
+source = "binlog"时作为从库读取dbFrom的行格式binlog, 删除的行也会被复制, binlog-replay离线回放binlog文件, 见src/dbreplic/binlogsource.go
  */
 
+// dbreplic [dbreplic.toml]
+// dbreplic prepare [dbreplic.toml]
+// dbreplic binlog-replay dbreplic.toml mysql-bin.000001 ...
 func main() {
-    dbReplicConfig := readDbReplicConfig()
-    dbFrom := mydb.GetDb(dbReplicConfig.DbFrom)
-    defer dbFrom.Close()
-    dbTo := mydb.GetDb(dbReplicConfig.DbTo)
+    if len(os.Args) > 1 && os.Args[1] == "prepare" {
+        prepare(readDbReplicConfig(configPath(2)))
+        return
+    }
+
+    replay := len(os.Args) > 1 && os.Args[1] == "binlog-replay"
+    if replay && len(os.Args) < 4 {
+        fmt.Println("Usage: dbreplic binlog-replay dbreplic.toml mysql-bin.000001 ...")
+        os.Exit(1)
+    }
+
+    fpath := configPath(1)
+    if replay {
+        fpath = os.Args[2]
+    }
+    dbReplicConfig := readDbReplicConfig(fpath)
+    binlog := replay || dbReplicConfig.Source == "binlog"
+
+    // 回放binlog文件时可以不配置dbFrom, 按binlog中的列元数据回放
+    var dbFrom *mydb.Db
+    if !replay || dbReplicConfig.DbFrom != "" {
+        dbFrom = mydb.GetDb(dbReplicConfig.DbFrom)
+        defer dbFrom.Close()
+    }
+    dbToDataSourceName := dbReplicConfig.DbTo
+    if binlog {
+        // go-mysql按UTC格式化TIMESTAMP
+        dbToDataSourceName = mydb.SetDsnParam(dbToDataSourceName, "time_zone", "'+00:00'")
+    }
+    dbTo := mydb.GetDb(dbToDataSourceName)
     defer dbTo.Close()
 
-    nodb, tempDir, _ := mynodb.OpenTemp()
-    defer os.RemoveAll(tempDir)
+    state, err := openState(dbReplicConfig)
+    myutil.CheckErr(err)
+    defer state.Close()
+
+    tableFilter, err := dbreplic.NewTableFilter(dbReplicConfig.Tables, dbReplicConfig.ExcludeTables)
+    myutil.CheckErr(err)
 
-    gocron.Every(5).Seconds().Do(mainTask, dbReplicConfig, nodb, dbFrom, dbTo)
+    options := dbreplic.Options{
+        DbFrom:     dbFrom,
+        DbTo:       dbTo,
+        State:      state,
+        BatchSize:  dbReplicConfig.BatchSize,
+        LagSeconds: dbReplicConfig.LagSeconds,
+        Progress:   printProgress,
+        Tables:     tableFilter,
+        OnTables:   printTableChange,
+        Applied:    printApplied,
+        Ddl:        printDdl,
+    }
+
+    if replay {
+        source := dbreplic.NewBinlogSource(options, dbReplicConfig.Binlog)
+        err := source.ReplayFiles(context.Background(), os.Args[3:])
+        position, _ := source.Position()
+        fmt.Printf("Applied %v rows, binlog at %v\n", appliedRows, position)
+        myutil.CheckErr(err)
+        return
+    }
+
+    if binlog {
+        myutil.CheckErr(dbReplicConfig.Binlog.Validate())
+        runBinlog(dbreplic.NewBinlogSource(options, dbReplicConfig.Binlog), dbReplicConfig.DbFrom)
+        return
+    }
+
+    gocron.Every(5).Seconds().Do(mainTask, dbreplic.NewReplicator(options))
     <-gocron.Start()
 }
 
-func mainTask(dbReplicConfig DbReplicConfig, nodb *mynodb.Nodb, dbFrom, dbTo *mydb.Db) {
-    fmt.Println(dbReplicConfig)
+// runBinlog applies the binlog of dbFrom, and connects again from the
+// checkpoint after errors.
+func runBinlog(source *dbreplic.BinlogSource, dataSourceName string) {
+    for {
+        position, err := source.Position()
+        myutil.CheckErr(err)
+        fmt.Println("Replicating binlog from", position)
+
+        err = source.Run(context.Background(), dataSourceName)
+        fmt.Println("Binlog replication stopped:", err)
+        time.Sleep(5 * time.Second)
+    }
+}
+
+var appliedRows, appliedPrinted = 0, time.Now()
+
+// printApplied prints the applied rows of the binlog every 10 seconds.
+func printApplied(position dbreplic.BinlogPosition, rows int) {
+    appliedRows += rows
+    if time.Now().Sub(appliedPrinted) >= 10*time.Second {
+        fmt.Printf("Applied %v rows, binlog at %v\n", appliedRows, position)
+        appliedRows, appliedPrinted = 0, time.Now()
+    }
+}
+
+// printDdl prints the DDL of the binlog, the skipped ones may need to be
+// applied to dbTo by hand.
+func printDdl(position dbreplic.BinlogPosition, query string, applied bool) {
+    if applied {
+        fmt.Printf("Applied DDL at %v: %v\n", position, query)
+    } else {
+        fmt.Printf("Skipped DDL at %v: %v\n", position, query)
+    }
+}
+
+// openState opens the state store in StateDir, or a temp store when StateDir is not set.
+func openState(dbReplicConfig DbReplicConfig) (mynodb.StateStore, error) {
+    if dbReplicConfig.StateDir == "" {
+        return mynodb.OpenTempStore(dbReplicConfig.StateBackend)
+    }
+
+    return mynodb.OpenStore(dbReplicConfig.StateBackend, dbReplicConfig.StateDir)
+}
+
+func printProgress(tableName string, copied, estimated int64) {
+    if estimated > 0 {
+        fmt.Printf("Copied %v/~%v rows of %v (%v%%)\n", copied, estimated, tableName, copied*100/estimated)
+    } else {
+        fmt.Printf("Copied %v rows of %v\n", copied, tableName)
+    }
+}
+
+func printTableChange(change dbreplic.TableChange) {
+    if len(change.Added) > 0 {
+        fmt.Println("Replicating tables:", strings.Join(change.Added, ", "))
+    }
+    if len(change.Removed) > 0 {
+        fmt.Println("Tables removed or no longer selected:", strings.Join(change.Removed, ", "))
+    }
+    if len(change.NotPrepared) > 0 {
+        fmt.Println("Tables without replication columns, run dbreplic prepare:", strings.Join(change.NotPrepared, ", "))
+    }
+}
+
+func mainTask(replicator *dbreplic.Replicator) {
+    results, ran, err := replicator.RunOnce(context.Background())
+    if !ran {
+        fmt.Println("Previous replication is not finished yet")
+        return
+    }
+
+    for _, result := range results {
+        if result.Err != nil {
+            fmt.Printf("Failed to replicate %v at %v: %v\n", result.Table, result.Watermark, result.Err)
+            continue
+        }
+        if result.Created {
+            fmt.Printf("Created table %v in dbTo\n", result.Table)
+        }
+        if result.Copied > 0 {
+            fmt.Printf("Copied %v rows of %v, replicating from %v\n", result.Copied, result.Table, result.Watermark)
+        }
+        if result.Rows > 0 {
+            fmt.Printf("Replicated %v rows of %v to %v in %v\n", result.Rows, result.Table, result.Watermark, result.Duration)
+        }
+    }
+    if err != nil {
+        fmt.Println("Replication failed:", err)
+    }
 }
 
 type DbReplicConfig struct {
     DbFrom        string `toml:"dbFrom"`
     DbTo          string `toml:"dbTo"`
-    ExcludeTables []string `toml:"excludeTables"`
+    Source        string `toml:"source"`       // watermark(默认, 按sys_sync_update_time轮询)或binlog
+    Tables        []string `toml:"tables"`        // 按顺序匹配的规则, 例如["+tr_f_*", "-/^tmp_\d+$/"], 不配置时复制所有表
+    ExcludeTables []string `toml:"excludeTables"` // 排除的表, 在tables之前匹配
+    StateDir      string `toml:"stateDir"`     // 状态库目录, 不配置时使用临时目录
+    StateBackend  string `toml:"stateBackend"` // nodb(默认)/memory/bolt
+    BatchSize     int    `toml:"batchSize"`    // 每个事务复制的行数, 默认1000
+    LagSeconds    int    `toml:"lagSeconds"`   // 只复制dbFrom当前时间之前该秒数修改的行, 默认1
+
+    Binlog dbreplic.BinlogOptions `toml:"binlog"`
+
+    // prepare
+    OnlineDdl       dbreplic.OnlineDdl `toml:"onlineDdl"`
+    LockWaitTimeout int                `toml:"lockWaitTimeout"` // ALTER TABLE等待元数据锁的秒数, 默认使用MySQL的设置
+}
+
+// prepare adds the missing replication columns and index to the tables of
+// dbFrom, and to the same tables of dbTo, after the operator confirms.
+func prepare(dbReplicConfig DbReplicConfig) {
+    ctx := context.Background()
+    tableFilter, err := dbreplic.NewTableFilter(dbReplicConfig.Tables, dbReplicConfig.ExcludeTables)
+    myutil.CheckErr(err)
+
+    var selected []string
+    var plans [][]dbreplic.TablePlan
+    var dbs []*mydb.Db
+    alters := 0
+    sides := []struct{ name, dataSourceName string }{
+        {"dbFrom", dbReplicConfig.DbFrom}, {"dbTo", dbReplicConfig.DbTo}}
+    for _, side := range sides {
+        dataSourceName := side.dataSourceName
+        if dbReplicConfig.LockWaitTimeout > 0 {
+            dataSourceName = mydb.SetDsnParam(dataSourceName, "lock_wait_timeout", strconv.Itoa(dbReplicConfig.LockWaitTimeout))
+        }
+        db := mydb.GetDb(dataSourceName)
+        defer db.Close()
+
+        tables, err := db.Tables(ctx)
+        myutil.CheckErr(err)
+        if selected == nil {
+            selected = tableFilter.Filter(tables)
+            tables = selected
+        } else {
+            tables = intersectTables(tables, selected)
+        }
+
+        sidePlans, err := dbreplic.PlanPrepare(ctx, db, tables)
+        myutil.CheckErr(err)
+        for _, plan := range sidePlans {
+            fmt.Println(side.name, plan)
+            if plan.NeedsAlter() {
+                alters += 1
+            }
+        }
+
+        plans = append(plans, sidePlans)
+        dbs = append(dbs, db)
+    }
+
+    if alters == 0 {
+        fmt.Println("Nothing to add")
+        return
+    }
+
+    if dbReplicConfig.OnlineDdl.PtOsc {
+        for i, db := range dbs {
+            database, err := db.CurrentDatabase(ctx)
+            myutil.CheckErr(err)
+            fmt.Println("# " + sides[i].name)
+            for _, plan := range plans[i] {
+                if plan.NeedsAlter() {
+                    command, err := dbreplic.PtOscCommand(sides[i].dataSourceName, database, plan, dbReplicConfig.OnlineDdl)
+                    myutil.CheckErr(err)
+                    fmt.Println(command)
+                }
+            }
+        }
+        return
+    }
+
+    for i, db := range dbs {
+        for _, plan := range plans[i] {
+            if plan.NeedsAlter() {
+                fmt.Println(dbreplic.AlterSql(db.Dialect(), plan, dbReplicConfig.OnlineDdl) + ";")
+            }
+        }
+    }
+
+    fmt.Printf("Run %v ALTER TABLE statements? (y/n): ", alters)
+    answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+    if strings.TrimSpace(answer) != "y" {
+        fmt.Println("Nothing altered")
+        return
+    }
+
+    for i, db := range dbs {
+        altered, err := dbreplic.ApplyPrepare(ctx, db, plans[i], dbReplicConfig.OnlineDdl)
+        for _, table := range altered {
+            fmt.Println("Altered " + table)
+        }
+        myutil.CheckErr(err)
+    }
 }
 
-func readDbReplicConfig() DbReplicConfig {
-    fpath := "dbreplic.toml"
-    if len(os.Args) > 1 {
-        fpath = os.Args[1]
+func intersectTables(tables, selected []string) []string {
+    result := make([]string, 0, len(tables))
+    for _, table := range tables {
+        for _, s := range selected {
+            if s == table {
+                result = append(result, table)
+                break
+            }
+        }
     }
 
+    return result
+}
+
+func configPath(argIndex int) string {
+    if len(os.Args) > argIndex {
+        return os.Args[argIndex]
+    }
+
+    return "dbreplic.toml"
+}
+
+func readDbReplicConfig(fpath string) DbReplicConfig {
     dbReplicConfig := DbReplicConfig{}
-    if _, err := toml.DecodeFile(fpath, &dbReplicConfig); err != nil {
+    if _, err := myconf.Load(fpath, "DBREPLIC", &dbReplicConfig); err != nil {
         myutil.CheckErr(err)
     }
 
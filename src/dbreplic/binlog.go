@@ -0,0 +1,294 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"context"
+	"fmt"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+解析行格式的binlog:
+1) WRITE_ROWS/UPDATE_ROWS/DELETE_ROWS事件转换为insert/update/delete变化, 值按列的顺序, update的前后镜像成对出现
+2) XID事件和COMMIT转换为commit变化, 带有该事件之后的binlog文件和位置, 以及按GTID事件更新的GTID集合.
+   SAVEPOINT等事务内的语句忽略, ROLLBACK转换为rollback变化, 其它语句(DDL)本身是一个事务, 转换为ddl变化, 同样带有之后的位置
+3) ParseBinlogFiles离线解析binlog文件, 不需要连接数据库, 复制连接收到的事件也按同样的方式转换(见binlogsource.go).
+   binlog_row_metadata=FULL时行变化带有表映射事件中的列名、类型和主键, 不需要dbFrom的表结构
+4) TIMESTAMP列按UTC格式化, DECIMAL解析为精确的十进制
+*/
+
+const (
+	ChangeInsert   = "insert"
+	ChangeUpdate   = "update"
+	ChangeDelete   = "delete"
+	ChangeCommit   = "commit"
+	ChangeRollback = "rollback" // 含有非事务表的事务回滚
+	ChangeDdl      = "ddl"
+)
+
+var rowsKinds = map[replication.EventType]string{
+	replication.WRITE_ROWS_EVENTv0:  ChangeInsert,
+	replication.WRITE_ROWS_EVENTv1:  ChangeInsert,
+	replication.WRITE_ROWS_EVENTv2:  ChangeInsert,
+	replication.UPDATE_ROWS_EVENTv0: ChangeUpdate,
+	replication.UPDATE_ROWS_EVENTv1: ChangeUpdate,
+	replication.UPDATE_ROWS_EVENTv2: ChangeUpdate,
+	replication.DELETE_ROWS_EVENTv0: ChangeDelete,
+	replication.DELETE_ROWS_EVENTv1: ChangeDelete,
+	replication.DELETE_ROWS_EVENTv2: ChangeDelete,
+}
+
+// BinlogPosition is the position after the last event of a committed
+// transaction.
+type BinlogPosition struct {
+	File    string
+	Pos     uint32
+	GtidSet string `json:",omitempty"` // 使用GTID时已执行的GTID集合
+}
+
+func (position BinlogPosition) String() string {
+	if position.File == "" && position.GtidSet == "" {
+		return "start"
+	}
+
+	s := fmt.Sprintf("%v:%v", position.File, position.Pos)
+	if position.GtidSet != "" {
+		s += " " + position.GtidSet
+	}
+
+	return s
+}
+
+// Change is a rows event, the end of a transaction, or a DDL.
+type Change struct {
+	Kind   string
+	Schema string
+	Table  string
+	// Rows are the values in the column order, the before and after images
+	// are in pairs for update.
+	Rows [][]interface{}
+	// Columns and KeyCols are in the table map event with
+	// binlog_row_metadata=FULL, nil otherwise.
+	Columns  []mydb.ColumnInfo
+	KeyCols  []string
+	Query    string         // DDL语句, Schema为执行时的默认库
+	Position BinlogPosition // commit或DDL之后的位置
+}
+
+// binlogReader turns the events into changes and tracks the position.
+type binlogReader struct {
+	position BinlogPosition
+	gtidSet  mysql.GTIDSet
+	gtid     string // 当前事务的GTID
+}
+
+func newBinlogReader(position BinlogPosition, useGtid bool) (*binlogReader, error) {
+	reader := &binlogReader{position: position}
+	if useGtid {
+		gtidSet, err := mysql.ParseMysqlGTIDSet(position.GtidSet)
+		if err != nil {
+			return nil, err
+		}
+		reader.gtidSet = gtidSet
+	}
+
+	return reader, nil
+}
+
+// change returns the change of the event, or nil for the other events.
+func (reader *binlogReader) change(event *replication.BinlogEvent) (*Change, error) {
+	if e, ok := event.Event.(*replication.RotateEvent); ok {
+		reader.position.File, reader.position.Pos = string(e.NextLogName), uint32(e.Position)
+		return nil, nil
+	}
+	if event.Header.LogPos > 0 {
+		reader.position.Pos = event.Header.LogPos
+	}
+
+	switch e := event.Event.(type) {
+	case *replication.GTIDEvent:
+		reader.gtid = formatGtid(e.SID, e.GNO)
+	case *replication.RowsEvent:
+		if kind := rowsKinds[event.Header.EventType]; kind != "" {
+			change := &Change{Kind: kind, Schema: string(e.Table.Schema), Table: string(e.Table.Table), Rows: e.Rows}
+			change.Columns, change.KeyCols = tableMapColumns(e.Table)
+			return change, nil
+		}
+	case *replication.XIDEvent:
+		return reader.end(&Change{Kind: ChangeCommit})
+	case *replication.QueryEvent:
+		query := strings.TrimSpace(string(e.Query))
+		upper := strings.ToUpper(query)
+		switch {
+		case upper == "BEGIN" || strings.HasPrefix(upper, "SAVEPOINT") || strings.HasPrefix(upper, "ROLLBACK TO") ||
+			strings.HasPrefix(upper, "RELEASE SAVEPOINT"):
+			return nil, nil
+		case upper == "COMMIT":
+			return reader.end(&Change{Kind: ChangeCommit})
+		case upper == "ROLLBACK":
+			reader.gtid = ""
+			return &Change{Kind: ChangeRollback}, nil
+		}
+		return reader.end(&Change{Kind: ChangeDdl, Schema: string(e.Schema), Query: query})
+	}
+
+	return nil, nil
+}
+
+// end sets the position after the transaction to the change.
+func (reader *binlogReader) end(change *Change) (*Change, error) {
+	if reader.gtidSet != nil && reader.gtid != "" {
+		if err := reader.gtidSet.Update(reader.gtid); err != nil {
+			return nil, err
+		}
+		reader.position.GtidSet = reader.gtidSet.String()
+	}
+	reader.gtid = ""
+
+	change.Position = reader.position
+	return change, nil
+}
+
+// tableMetadata is the optional metadata of a table map event.
+type tableMetadata struct {
+	names      []string
+	types      []byte
+	metas      []uint16
+	unsigned   map[int]bool
+	enums      map[int][]string
+	sets       map[int][]string
+	primaryKey []uint64
+}
+
+var metadataTypes = map[byte]string{
+	mysql.MYSQL_TYPE_TINY:     "tinyint",
+	mysql.MYSQL_TYPE_SHORT:    "smallint",
+	mysql.MYSQL_TYPE_INT24:    "mediumint",
+	mysql.MYSQL_TYPE_LONG:     "int",
+	mysql.MYSQL_TYPE_LONGLONG: "bigint",
+	mysql.MYSQL_TYPE_BIT:      "bit",
+}
+
+func tableMapColumns(e *replication.TableMapEvent) ([]mydb.ColumnInfo, []string) {
+	return metadataColumns(tableMetadata{e.ColumnNameString(), e.ColumnType, e.ColumnMeta, e.UnsignedMap(),
+		e.EnumStrValueMap(), e.SetStrValueMap(), e.PrimaryKey})
+}
+
+// metadataColumns makes the columns and the primary key from the metadata,
+// only the types used to format the values are named, nil is returned
+// without the column names.
+func metadataColumns(metadata tableMetadata) ([]mydb.ColumnInfo, []string) {
+	if len(metadata.names) == 0 || len(metadata.names) != len(metadata.types) {
+		return nil, nil
+	}
+
+	infos := make([]mydb.ColumnInfo, len(metadata.names))
+	for i, name := range metadata.names {
+		info := mydb.ColumnInfo{Name: name, DataType: metadataTypes[metadata.types[i]], Unsigned: metadata.unsigned[i]}
+		switch {
+		case metadata.enums[i] != nil:
+			info.DataType, info.ColumnType = "enum", "enum("+quoteMembers(metadata.enums[i])+")"
+		case metadata.sets[i] != nil:
+			info.DataType, info.ColumnType = "set", "set("+quoteMembers(metadata.sets[i])+")"
+		case info.DataType == "bit" && i < len(metadata.metas):
+			// 元数据的高字节为整字节数, 低字节为剩余的位数
+			meta := metadata.metas[i]
+			info.ColumnType = fmt.Sprintf("bit(%d)", int(meta>>8)*8+int(meta&0xff))
+		}
+		infos[i] = info
+	}
+
+	keyCols := make([]string, 0, len(metadata.primaryKey))
+	for _, i := range metadata.primaryKey {
+		if int(i) < len(metadata.names) {
+			keyCols = append(keyCols, metadata.names[i])
+		}
+	}
+
+	return infos, keyCols
+}
+
+func quoteMembers(members []string) string {
+	quoted := make([]string, len(members))
+	for i, member := range members {
+		quoted[i] = "'" + strings.Replace(member, "'", "''", -1) + "'"
+	}
+
+	return strings.Join(quoted, ",")
+}
+
+const ddlName = "(?:(`[^`]+`|\\w+)\\.)?(`[^`]+`|\\w+)"
+
+var ddlTableRegexps = []*regexp.Regexp{
+	regexp.MustCompile("(?is)^(?:(?:create|alter|drop)\\s+(?:temporary\\s+)?table|rename\\s+table|truncate(?:\\s+table)?)\\s+" +
+		"(?:if\\s+(?:not\\s+)?exists\\s+)?" + ddlName),
+	regexp.MustCompile("(?is)^(?:create|drop)\\s+(?:(?:unique|fulltext|spatial)\\s+)?index\\s+\\S+\\s+on\\s+" + ddlName),
+}
+
+// ddlTable finds the first table of the table DDL, schema is empty when the
+// table is not qualified.
+func ddlTable(query string) (schema, table string, ok bool) {
+	for _, re := range ddlTableRegexps {
+		if m := re.FindStringSubmatch(query); m != nil {
+			return strings.Trim(m[1], "`"), strings.Trim(m[2], "`"), true
+		}
+	}
+
+	return "", "", false
+}
+
+// formatGtid formats the GTID like "3E11FA47-71CA-11E1-9E33-C80AA9429562:23".
+func formatGtid(sid []byte, gno int64) string {
+	if len(sid) != 16 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x:%d", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16], gno)
+}
+
+// ParseBinlogFiles parses the binlog files in order after the position, the
+// files before position.File are skipped, and fn is called with every change.
+func ParseBinlogFiles(ctx context.Context, files []string, position BinlogPosition, useGtid bool,
+	fn func(change Change) error) error {
+	reader, err := newBinlogReader(position, useGtid)
+	if err != nil {
+		return err
+	}
+
+	parser := replication.NewBinlogParser()
+	parser.SetTimestampStringLocation(time.UTC)
+	parser.SetUseDecimal(true)
+	for _, file := range files {
+		name, offset := filepath.Base(file), int64(4)
+		if position.File != "" && name < position.File {
+			continue
+		}
+		if name == position.File && position.Pos > 4 {
+			offset = int64(position.Pos)
+		}
+
+		reader.position.File, reader.position.Pos = name, uint32(offset)
+		err := parser.ParseFile(file, offset, func(event *replication.BinlogEvent) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			change, err := reader.change(event)
+			if err != nil || change == nil {
+				return err
+			}
+
+			return fn(*change)
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %v", file, err)
+		}
+	}
+
+	return nil
+}
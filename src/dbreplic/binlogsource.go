@@ -0,0 +1,638 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+基于binlog的复制(source = "binlog"):
+1) 作为从库用复制协议连接dbFrom读取行格式的binlog(binlog_format=ROW, binlog_row_image=FULL), 或者离线回放binlog文件(binlog-replay)
+2) insert按主键upsert, update主键变化时先删除旧行再upsert, delete按主键删除, 没有主键时按sys_sync_id, 所以删除的行也会被复制
+3) binlog中的一个事务在dbTo的一个事务中执行, 提交后把binlog文件和位置(使用GTID时还有GTID集合)保存在状态库中,
+   中断后从上一次提交的位置重新开始
+4) 只复制dbFrom当前库(或Schema)中选中的表(见tables.go), dbTo中没有的表按dbFrom的表结构创建, 不要求sys_sync_*列
+5) 事件中的列按dbFrom当前的表结构命名, DDL之后重新读取表结构, 所以回放的binlog之后表结构不能再改变.
+   不配置dbFrom回放binlog文件时按binlog中的列元数据(binlog_row_metadata=FULL)命名, 需要配置Schema, 表需要已在dbTo中.
+   选中的表的DDL(CREATE/ALTER/DROP/RENAME/TRUNCATE TABLE, CREATE/DROP INDEX)在dbTo中执行, dbTo中还没有的表除CREATE外跳过,
+   其它语句不执行, 都通过Ddl回调报告. 只在事务提交和DDL之后保存位置
+6) 没有检查点时从Start或dbFrom当前的位置(SHOW BINARY LOG STATUS)开始, 已有的行不会被复制.
+   TIMESTAMP按UTC复制, dbTo的连接需要设置time_zone='+00:00', 否则不开始复制
+7) DECIMAL按精确的十进制复制, ENUM/SET按dbFrom列类型中的成员转换为字符串, BIT转换为与读取时相同的字节串
+*/
+
+// BinlogOptions are the settings of the binlog source.
+type BinlogOptions struct {
+	ServerId uint32 `toml:"serverId"` // 连接dbFrom的从库server_id, 不能和其它从库相同
+	Flavor   string `toml:"flavor"`   // mysql(默认)或mariadb
+	Gtid     bool   `toml:"gtid"`     // 按GTID集合开始复制, 只支持mysql
+	Start    string `toml:"start"`    // 没有检查点时开始的位置, 例如"mysql-bin.000003:4", 使用GTID时为GTID集合
+	Schema   string `toml:"schema"`   // 复制的库, 默认为dbFrom的当前库, 不配置dbFrom回放时需要
+}
+
+const binlogPositionKey = "binlog:position"
+
+type binlogTable struct {
+	columns []binlogColumn
+	keyCols []string
+	skip    bool // 没有选中, 或者dbFrom中已经没有这个表
+}
+
+// binlogColumn is a column with the metadata to format its binlog values.
+type binlogColumn struct {
+	mydb.ColumnInfo
+	members []string // enum和set的成员
+	bits    int      // bit的位数
+}
+
+func newBinlogColumn(info mydb.ColumnInfo) binlogColumn {
+	column := binlogColumn{ColumnInfo: info}
+	start, end := strings.Index(info.ColumnType, "("), strings.LastIndex(info.ColumnType, ")")
+	if start < 0 || end < start {
+		return column
+	}
+
+	switch info.DataType {
+	case "enum", "set":
+		column.members = typeMembers(info.ColumnType[start+1 : end])
+	case "bit":
+		column.bits, _ = strconv.Atoi(info.ColumnType[start+1 : end])
+	}
+
+	return column
+}
+
+// typeMembers splits the quoted members like 'a','b”c'.
+func typeMembers(s string) []string {
+	members := make([]string, 0)
+	member, quoted := "", false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\'' && quoted && i+1 < len(s) && s[i+1] == '\'':
+			member += "'"
+			i++
+		case s[i] == '\'':
+			if quoted {
+				members = append(members, member)
+				member = ""
+			}
+			quoted = !quoted
+		case quoted:
+			member += string(s[i])
+		}
+	}
+
+	return members
+}
+
+// binlogSchema gives the columns of the tables in the binlog.
+type binlogSchema interface {
+	// columns returns the columns and the primary key of the table of the
+	// change, no columns when the table does not exist.
+	columns(ctx context.Context, change Change) ([]mydb.ColumnInfo, []string, error)
+}
+
+// dbFromSchema reads the current columns in dbFrom.
+type dbFromSchema struct {
+	db *mydb.Db
+}
+
+func (schema dbFromSchema) columns(ctx context.Context, change Change) ([]mydb.ColumnInfo, []string, error) {
+	infos, err := schema.db.ColumnInfos(ctx, change.Table)
+	if err != nil || len(infos) == 0 {
+		return nil, nil, err
+	}
+
+	keyCols, err := schema.db.PrimaryKey(ctx, change.Table)
+	return infos, keyCols, err
+}
+
+// metadataSchema takes the columns in the binlog, which works without dbFrom.
+type metadataSchema struct{}
+
+func (metadataSchema) columns(ctx context.Context, change Change) ([]mydb.ColumnInfo, []string, error) {
+	if change.Columns == nil {
+		return nil, nil, fmt.Errorf("%v: no column names in the binlog, binlog_row_metadata=FULL or dbFrom is needed",
+			change.Table)
+	}
+
+	return change.Columns, change.KeyCols, nil
+}
+
+// BinlogSource applies the row changes of the dbFrom binlog to dbTo.
+type BinlogSource struct {
+	options  Options
+	binlog   BinlogOptions
+	database string
+	schema   binlogSchema
+	tables   map[string]*binlogTable
+	tx       *mydb.Tx
+	rows     int // 当前事务中的行数
+}
+
+func NewBinlogSource(options Options, binlog BinlogOptions) *BinlogSource {
+	if binlog.Flavor == "" {
+		binlog.Flavor = mysql.MySQLFlavor
+	}
+
+	source := &BinlogSource{options: options, binlog: binlog, schema: metadataSchema{}, tables: make(map[string]*binlogTable)}
+	if options.DbFrom != nil {
+		source.schema = dbFromSchema{options.DbFrom}
+	}
+
+	return source
+}
+
+func (binlog BinlogOptions) Validate() error {
+	if binlog.ServerId == 0 {
+		return errors.New("binlog.serverId is required")
+	}
+	if binlog.Flavor != "" && binlog.Flavor != mysql.MySQLFlavor && binlog.Flavor != mysql.MariaDBFlavor {
+		return errors.New("binlog.flavor should be mysql or mariadb")
+	}
+	if binlog.Gtid && binlog.Flavor == mysql.MariaDBFlavor {
+		return errors.New("binlog.gtid is only supported by mysql")
+	}
+
+	return nil
+}
+
+// Position returns the checkpoint, which is empty before the first
+// committed transaction.
+func (source *BinlogSource) Position() (BinlogPosition, error) {
+	position := BinlogPosition{}
+	value, err := source.options.State.Get(binlogPositionKey)
+	if err != nil || value == "" {
+		return position, err
+	}
+
+	err = json.Unmarshal([]byte(value), &position)
+	return position, err
+}
+
+func (source *BinlogSource) SetPosition(position BinlogPosition) error {
+	value, _ := json.Marshal(position)
+	return source.options.State.Set(binlogPositionKey, string(value))
+}
+
+// startPosition is the checkpoint, or Start, or the current position of dbFrom.
+func (source *BinlogSource) startPosition(ctx context.Context) (BinlogPosition, error) {
+	position, err := source.Position()
+	if err != nil || position.File != "" || position.GtidSet != "" {
+		return position, err
+	}
+
+	if source.binlog.Start != "" {
+		if source.binlog.Gtid {
+			return BinlogPosition{GtidSet: source.binlog.Start}, nil
+		}
+		i := strings.LastIndex(source.binlog.Start, ":")
+		pos, err := strconv.ParseUint(source.binlog.Start[i+1:], 10, 32)
+		if i < 0 || err != nil {
+			return position, errors.New("binlog.start should be like mysql-bin.000003:4")
+		}
+		return BinlogPosition{File: source.binlog.Start[:i], Pos: uint32(pos)}, nil
+	}
+
+	status, err := source.options.DbFrom.BinlogStatus(ctx)
+	if err != nil {
+		return position, err
+	}
+	if status.File == "" {
+		return position, errors.New("binlog is not enabled in dbFrom")
+	}
+
+	position = BinlogPosition{File: status.File, Pos: uint32(status.Position)}
+	if source.binlog.Gtid {
+		position.GtidSet = status.GtidSet
+	}
+
+	return position, nil
+}
+
+// checkFormat checks the binlog settings of dbFrom.
+func (source *BinlogSource) checkFormat(ctx context.Context) error {
+	rows, err := readRows(ctx, source.options.DbFrom,
+		"select @@global.binlog_format as binlog_format, @@global.binlog_row_image as binlog_row_image")
+	if err != nil {
+		return err
+	}
+
+	if format := rows[0]["binlog_format"]; format != "ROW" {
+		return fmt.Errorf("binlog_format of dbFrom is %v, ROW is required", format)
+	}
+	if image := rows[0]["binlog_row_image"]; image != "FULL" {
+		return fmt.Errorf("binlog_row_image of dbFrom is %v, FULL is required", image)
+	}
+
+	return nil
+}
+
+func (source *BinlogSource) init(ctx context.Context) error {
+	database := source.binlog.Schema
+	if database == "" {
+		if source.options.DbFrom == nil {
+			return errors.New("binlog.schema is required without dbFrom")
+		}
+
+		var err error
+		if database, err = source.options.DbFrom.CurrentDatabase(ctx); err != nil {
+			return err
+		}
+	}
+
+	// binlog中的TIMESTAMP按UTC格式化(TimestampStringLocation)
+	_, _, offset, err := source.options.DbTo.TimeZone(ctx)
+	if err != nil {
+		return err
+	}
+	if offset != "00:00:00" {
+		return fmt.Errorf("the time_zone of dbTo is %v from UTC, '+00:00' is required", offset)
+	}
+
+	source.database = database
+	source.tables = make(map[string]*binlogTable)
+	return nil
+}
+
+// Run connects to dbFrom as a replica and applies the changes until ctx is
+// done or an error, it starts again from the checkpoint next time.
+func (source *BinlogSource) Run(ctx context.Context, dataSourceName string) error {
+	if err := source.checkFormat(ctx); err != nil {
+		return err
+	}
+	if err := source.init(ctx); err != nil {
+		return err
+	}
+	defer source.rollback()
+
+	position, err := source.startPosition(ctx)
+	if err != nil {
+		return err
+	}
+
+	config, err := syncerConfig(dataSourceName)
+	if err != nil {
+		return err
+	}
+	config.ServerID, config.Flavor = source.binlog.ServerId, source.binlog.Flavor
+	syncer := replication.NewBinlogSyncer(config)
+	defer syncer.Close()
+
+	var streamer *replication.BinlogStreamer
+	if source.binlog.Gtid {
+		gtidSet, err := mysql.ParseMysqlGTIDSet(position.GtidSet)
+		if err != nil {
+			return err
+		}
+		streamer, err = syncer.StartSyncGTID(gtidSet)
+	} else {
+		streamer, err = syncer.StartSync(mysql.Position{Name: position.File, Pos: position.Pos})
+	}
+	if err != nil {
+		return err
+	}
+
+	reader, err := newBinlogReader(position, source.binlog.Gtid)
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return err
+		}
+
+		change, err := reader.change(event)
+		if err == nil && change != nil {
+			err = source.apply(ctx, *change)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// syncerConfig takes the address and the account of a go-sql-driver/mysql
+// data source name.
+func syncerConfig(dataSourceName string) (replication.BinlogSyncerConfig, error) {
+	config := replication.BinlogSyncerConfig{TimestampStringLocation: time.UTC, UseDecimal: true}
+	dsn, err := driver.ParseDSN(dataSourceName)
+	if err != nil {
+		return config, err
+	}
+	if dsn.Net != "tcp" {
+		return config, errors.New("the binlog source only connects to dbFrom over tcp")
+	}
+
+	host, port, err := net.SplitHostPort(dsn.Addr)
+	if err != nil {
+		return config, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return config, err
+	}
+
+	config.Host, config.Port, config.User, config.Password = host, uint16(portNumber), dsn.User, dsn.Passwd
+	return config, nil
+}
+
+// ReplayFiles applies the binlog files of dbFrom after the checkpoint, the
+// files should be in order.
+func (source *BinlogSource) ReplayFiles(ctx context.Context, files []string) error {
+	if err := source.init(ctx); err != nil {
+		return err
+	}
+	defer source.rollback()
+
+	position, err := source.Position()
+	if err != nil {
+		return err
+	}
+
+	return ParseBinlogFiles(ctx, files, position, source.binlog.Gtid, func(change Change) error {
+		return source.apply(ctx, change)
+	})
+}
+
+func (source *BinlogSource) rollback() {
+	if source.tx != nil {
+		source.tx.Rollback()
+		source.tx, source.rows = nil, 0
+	}
+}
+
+// apply writes the change in the transaction of dbTo, and saves the
+// position after commit.
+func (source *BinlogSource) apply(ctx context.Context, change Change) error {
+	switch change.Kind {
+	case ChangeCommit:
+		return source.commit(change)
+	case ChangeRollback:
+		source.rollback()
+		return nil
+	case ChangeDdl:
+		return source.ddl(ctx, change)
+	}
+	if change.Schema != source.database {
+		return nil
+	}
+
+	table, err := source.table(ctx, change)
+	if err != nil || table.skip {
+		return err
+	}
+	if len(change.Rows) > 0 && len(change.Rows[0]) != len(table.columns) {
+		return fmt.Errorf("%v: %v columns in the binlog but %v in dbFrom, the table is altered after the event",
+			change.Table, len(change.Rows[0]), len(table.columns))
+	}
+
+	if source.tx == nil {
+		if source.tx, err = source.options.DbTo.BeginTx(ctx); err != nil {
+			return err
+		}
+	}
+
+	tx := source.tx
+	switch change.Kind {
+	case ChangeInsert:
+		for _, values := range change.Rows {
+			row := table.row(values)
+			_, err = tx.UpsertRowContext(ctx, change.Table, table.keyCols, row, updateColumns(table.keyCols, row))
+			if err != nil {
+				return err
+			}
+		}
+		source.rows += len(change.Rows)
+	case ChangeUpdate:
+		for i := 0; i+1 < len(change.Rows); i += 2 {
+			before, after := table.row(change.Rows[i]), table.row(change.Rows[i+1])
+			for _, col := range table.keyCols {
+				if before[col] != after[col] {
+					if _, err := tx.DeleteKeysContext(ctx, change.Table, table.keyCols, before); err != nil {
+						return err
+					}
+					break
+				}
+			}
+			_, err = tx.UpsertRowContext(ctx, change.Table, table.keyCols, after, updateColumns(table.keyCols, after))
+			if err != nil {
+				return err
+			}
+		}
+		source.rows += len(change.Rows) / 2
+	case ChangeDelete:
+		for _, values := range change.Rows {
+			if _, err := tx.DeleteKeysContext(ctx, change.Table, table.keyCols, table.row(values)); err != nil {
+				return err
+			}
+		}
+		source.rows += len(change.Rows)
+	}
+
+	return nil
+}
+
+func (source *BinlogSource) commit(change Change) error {
+	if source.tx != nil {
+		err := source.tx.Commit()
+		source.tx = nil
+		if err != nil {
+			return err
+		}
+	}
+	if err := source.SetPosition(change.Position); err != nil {
+		return err
+	}
+
+	if source.rows > 0 && source.options.Applied != nil {
+		source.options.Applied(change.Position, source.rows)
+	}
+	source.rows = 0
+	return nil
+}
+
+// ddl executes the DDL of a selected table in dbTo, the other statements
+// are skipped, and saves the position after it.
+func (source *BinlogSource) ddl(ctx context.Context, change Change) error {
+	if source.tx != nil {
+		return fmt.Errorf("DDL inside a transaction at %v: %v", change.Position, change.Query)
+	}
+
+	schema, tableName, ok := ddlTable(change.Query)
+	if schema == "" {
+		schema = change.Schema
+	}
+	if !ok && schema != source.database {
+		// 其它库的语句和其它库的行一样不复制
+		return source.SetPosition(change.Position)
+	}
+
+	applied := false
+	if ok && schema == source.database && source.options.Tables.Match(tableName) {
+		exists, err := source.options.DbTo.TableExists(ctx, tableName)
+		if err != nil {
+			return err
+		}
+
+		// dbTo中还没有的表在第一次有行时按dbFrom的表结构创建
+		if exists || strings.HasPrefix(strings.ToUpper(change.Query), "CREATE TABLE") {
+			query := qualifiedRegexp(source.database).ReplaceAllString(change.Query, "")
+			if _, err := source.options.DbTo.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("DDL at %v: %v: %v", change.Position, change.Query, err)
+			}
+			applied = true
+		}
+	}
+
+	// DDL之后重新读取表结构
+	source.tables = make(map[string]*binlogTable)
+	if err := source.SetPosition(change.Position); err != nil {
+		return err
+	}
+
+	if schema == source.database && source.options.Ddl != nil {
+		source.options.Ddl(change.Position, change.Query, applied)
+	}
+	return nil
+}
+
+// qualifiedRegexp matches the qualifier of the database like `db`. or db.
+// in a statement, the DDL is executed in the database of dbTo.
+func qualifiedRegexp(database string) *regexp.Regexp {
+	return regexp.MustCompile("(`" + regexp.QuoteMeta(database) + "`|\\b" + regexp.QuoteMeta(database) + ")\\.")
+}
+
+// table reads the columns and the key of the table of the change, and
+// creates the table in dbTo when it does not exist.
+func (source *BinlogSource) table(ctx context.Context, change Change) (*binlogTable, error) {
+	tableName := change.Table
+	if table, ok := source.tables[tableName]; ok {
+		return table, nil
+	}
+
+	table := &binlogTable{skip: !source.options.Tables.Match(tableName)}
+	var keyCols []string
+	if !table.skip {
+		infos, pk, err := source.schema.columns(ctx, change)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			table.columns = append(table.columns, newBinlogColumn(info))
+		}
+		table.skip, keyCols = len(infos) == 0, pk
+	}
+	if table.skip {
+		source.tables[tableName] = table
+		return table, nil
+	}
+
+	if len(keyCols) == 0 {
+		for _, column := range table.columns {
+			if column.Name == SyncIdColumn {
+				keyCols = []string{SyncIdColumn}
+			}
+		}
+	}
+	if len(keyCols) == 0 {
+		return nil, fmt.Errorf("%v: no primary key or %v", tableName, SyncIdColumn)
+	}
+	table.keyCols = keyCols
+
+	if source.options.DbFrom != nil {
+		if _, err := createTable(ctx, source.options.DbFrom, source.options.DbTo, tableName); err != nil {
+			return nil, err
+		}
+	} else if exists, err := source.options.DbTo.TableExists(ctx, tableName); err != nil || !exists {
+		if err == nil {
+			err = fmt.Errorf("%v: the table is not in dbTo, dbFrom is needed to create it", tableName)
+		}
+		return nil, err
+	}
+
+	source.tables[tableName] = table
+	return table, nil
+}
+
+// row names the values by the columns, in the format read by mydb.
+func (table *binlogTable) row(values []interface{}) map[string]string {
+	row := make(map[string]string, len(values))
+	for i, value := range values {
+		row[table.columns[i].Name] = binlogValue(table.columns[i], value)
+	}
+
+	return row
+}
+
+// binlogValue formats the value decoded by go-mysql, the unsigned integers
+// are decoded as signed, and enum, set and bit as the integers.
+func binlogValue(info binlogColumn, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case int8:
+		if info.Unsigned {
+			return strconv.FormatUint(uint64(uint8(v)), 10)
+		}
+	case int16:
+		if info.Unsigned {
+			return strconv.FormatUint(uint64(uint16(v)), 10)
+		}
+	case int32:
+		if info.Unsigned && info.DataType == "mediumint" {
+			return strconv.FormatUint(uint64(uint32(v)&0xffffff), 10)
+		}
+		if info.Unsigned {
+			return strconv.FormatUint(uint64(uint32(v)), 10)
+		}
+	case int64:
+		switch info.DataType {
+		case "enum":
+			if v > 0 && int(v) <= len(info.members) {
+				return info.members[v-1]
+			}
+			return "" // 无效值在MySQL中是空字符串
+		case "set":
+			members := make([]string, 0)
+			for i, member := range info.members {
+				if v&(1<<uint(i)) != 0 {
+					members = append(members, member)
+				}
+			}
+			return strings.Join(members, ",")
+		case "bit":
+			// go-sql-driver把bit读取为大端字节串
+			b := make([]byte, (info.bits+7)/8)
+			for i := len(b) - 1; i >= 0; i-- {
+				b[i], v = byte(v), v>>8
+			}
+			return string(b)
+		}
+		if info.Unsigned {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+	}
+
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,98 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestBinlogValue(t *testing.T) {
+	column := func(dataType, columnType string, unsigned bool) binlogColumn {
+		return newBinlogColumn(mydb.ColumnInfo{DataType: dataType, ColumnType: columnType, Unsigned: unsigned})
+	}
+
+	tests := []struct {
+		column binlogColumn
+		value  interface{}
+		want   string
+	}{
+		{column("varchar", "varchar(20)", false), nil, "NULL"},
+		{column("varchar", "varchar(20)", false), "abc", "abc"},
+		{column("blob", "blob", false), []byte{0, 'x'}, "\x00x"},
+		{column("double", "double", false), float64(0.1), "0.1"},
+		{column("float", "float", false), float32(1.5), "1.5"},
+		{column("tinyint", "tinyint(3) unsigned", true), int8(-1), "255"},
+		{column("tinyint", "tinyint(4)", false), int8(-1), "-1"},
+		{column("smallint", "smallint(5) unsigned", true), int16(-2), "65534"},
+		{column("mediumint", "mediumint(8) unsigned", true), int32(-1), "16777215"},
+		{column("int", "int(10) unsigned", true), int32(-1), "4294967295"},
+		{column("int", "int(11)", false), int32(-7), "-7"},
+		{column("bigint", "bigint(20) unsigned", true), int64(-1), "18446744073709551615"},
+		{column("bigint", "bigint(20)", false), int64(-1), "-1"},
+		{column("enum", "enum('new','it''s paid')", false), int64(2), "it's paid"},
+		{column("enum", "enum('new','paid')", false), int64(0), ""},
+		{column("set", "set('a','b','c')", false), int64(5), "a,c"},
+		{column("set", "set('a','b','c')", false), int64(0), ""},
+		{column("bit", "bit(1)", false), int64(1), "\x01"},
+		{column("bit", "bit(10)", false), int64(0x201), "\x02\x01"},
+		{column("datetime", "datetime", false), "2024-05-01 08:00:00", "2024-05-01 08:00:00"},
+	}
+	for _, test := range tests {
+		if got := binlogValue(test.column, test.value); got != test.want {
+			t.Errorf("binlogValue(%v, %#v) = %q, want %q", test.column.ColumnType, test.value, got, test.want)
+		}
+	}
+}
+
+func TestTypeMembers(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"'a','b'", []string{"a", "b"}},
+		{"'it''s','',' x,y'", []string{"it's", "", " x,y"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		if got := typeMembers(test.s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("typeMembers(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+// TestMetadataSchemaRow names the values of a rows event by the column
+// metadata in the binlog, as the replay without dbFrom does.
+func TestMetadataSchemaRow(t *testing.T) {
+	infos, keyCols := metadataColumns(tableMetadata{
+		names:      []string{"id", "state", "amount", "paid_at"},
+		types:      []byte{0, 0, 0, 0},
+		unsigned:   map[int]bool{},
+		enums:      map[int][]string{1: {"new", "paid"}},
+		primaryKey: []uint64{0},
+	})
+	change := Change{Kind: ChangeInsert, Schema: "shop", Table: "orders", Columns: infos, KeyCols: keyCols,
+		Rows: [][]interface{}{{int32(7), int64(2), "12.50", nil}}}
+
+	columns, pk, err := metadataSchema{}.columns(context.Background(), change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &binlogTable{keyCols: pk}
+	for _, info := range columns {
+		table.columns = append(table.columns, newBinlogColumn(info))
+	}
+
+	want := map[string]string{"id": "7", "state": "paid", "amount": "12.50", "paid_at": "NULL"}
+	if row := table.row(change.Rows[0]); !reflect.DeepEqual(row, want) {
+		t.Errorf("row = %v, want %v", row, want)
+	}
+	if !reflect.DeepEqual(table.keyCols, []string{"id"}) {
+		t.Errorf("keyCols = %v, want [id]", table.keyCols)
+	}
+
+	change.Columns = nil
+	if _, _, err := (metadataSchema{}).columns(context.Background(), change); err == nil {
+		t.Error("columns without the metadata should fail")
+	}
+}
@@ -0,0 +1,139 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"context"
+	"encoding/json"
+	"regexp"
+)
+
+/*
+初始复制:
+1) dbTo中没有的表按dbFrom的SHOW CREATE TABLE创建(去掉AUTO_INCREMENT=n)
+2) 记录开始时间(dbFrom当前时间减LagSeconds), 按sys_sync_id顺序每BatchSize行一个事务upsert到dbTo, 每批后报告进度并保存复制到的sys_sync_id, 中断后继续
+3) 复制完成后把水位设为开始时间, 之后按增量复制, 复制期间修改的行会再复制一次
+*/
+
+type copyState struct {
+	Start  string // 开始复制时dbFrom的时间
+	LastId string // 已复制的最后一行的sys_sync_id
+}
+
+func copyKey(tableName string) string {
+	return "copy:" + tableName
+}
+
+var autoIncrementOptionRegexp = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// initialCopy creates the missing table in dbTo, copies all the rows, and
+// sets the watermark to the time the copy starts.
+func (r *Replicator) initialCopy(ctx context.Context, table *mydb.Table, keyCols []string, result *TableResult) error {
+	created, err := createTable(ctx, r.options.DbFrom, r.options.DbTo, table.Name)
+	if err != nil {
+		return err
+	}
+	result.Created = created
+
+	state, err := r.copyState(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+
+	estimated, err := r.options.DbFrom.EstimatedRows(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+
+	for {
+		sql, args, err := r.copySql(table, state)
+		if err != nil {
+			return err
+		}
+
+		chunk, err := readRows(ctx, r.options.DbFrom, sql, args...)
+		if err == nil && len(chunk) > 0 {
+			err = r.applyBatch(ctx, table.Name, keyCols, chunk)
+		}
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+
+		state.LastId = chunk[len(chunk)-1][SyncIdColumn]
+		if err := r.setCopyState(table.Name, state); err != nil {
+			return err
+		}
+
+		result.Copied += int64(len(chunk))
+		if r.options.Progress != nil {
+			r.options.Progress(table.Name, result.Copied, estimated)
+		}
+		if len(chunk) < r.options.BatchSize {
+			break
+		}
+	}
+
+	result.Watermark = Watermark{UpdateTime: state.Start}
+	if err := r.SetWatermark(table.Name, result.Watermark); err != nil {
+		return err
+	}
+
+	return r.options.State.Delete(copyKey(table.Name))
+}
+
+// copySql reads the next chunk after the last copied row, sys_sync_id is
+// compared as an integer.
+func (r *Replicator) copySql(table *mydb.Table, state copyState) (string, []interface{}, error) {
+	query := table.Select()
+	if state.LastId != "" {
+		query.Where(SyncIdColumn, ">", table.Infos[SyncIdColumn].Arg(state.LastId))
+	}
+
+	return query.OrderBy(SyncIdColumn).Limit(r.options.BatchSize).Sql()
+}
+
+// createTable creates the table in dbTo as in dbFrom when it does not exist,
+// and tells whether it is created.
+func createTable(ctx context.Context, dbFrom, dbTo *mydb.Db, tableName string) (bool, error) {
+	exists, err := dbTo.TableExists(ctx, tableName)
+	if err != nil || exists {
+		return false, err
+	}
+
+	create, err := dbFrom.ShowCreate(ctx, "TABLE", tableName)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := dbTo.ExecContext(ctx, autoIncrementOptionRegexp.ReplaceAllString(create, "")); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// copyState returns the state of an interrupted copy, or starts a new one.
+func (r *Replicator) copyState(ctx context.Context, tableName string) (copyState, error) {
+	state := copyState{}
+	value, err := r.options.State.Get(copyKey(tableName))
+	if err != nil {
+		return state, err
+	}
+	if value != "" {
+		err = json.Unmarshal([]byte(value), &state)
+		return state, err
+	}
+
+	if state.Start, err = r.upperTime(ctx); err != nil {
+		return state, err
+	}
+
+	return state, r.setCopyState(tableName, state)
+}
+
+func (r *Replicator) setCopyState(tableName string, state copyState) error {
+	value, _ := json.Marshal(state)
+	return r.options.State.Set(copyKey(tableName), string(value))
+}
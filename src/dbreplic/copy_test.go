@@ -0,0 +1,36 @@
+package dbreplic
+
+import (
+	"../mynodb"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestResumeCopy(t *testing.T) {
+	r := NewReplicator(Options{State: mynodb.NewMemStore(), BatchSize: 100})
+	table := syncTable()
+
+	sql, args, err := r.copySql(table, copyState{Start: "2024-05-01 10:00:00"})
+	want := `select * from "t" order by "sys_sync_id" limit 100`
+	if err != nil || sql != want || len(args) != 0 {
+		t.Errorf("copySql of a new copy = %v, %v, %v, want %v", sql, args, err, want)
+	}
+
+	// 中断的复制从copy:<表名>中保存的位置继续, 不再读取dbFrom的时间
+	saved := copyState{Start: "2024-05-01 10:00:00", LastId: "9007199254740993"}
+	if err := r.setCopyState(table.Name, saved); err != nil {
+		t.Fatal(err)
+	}
+	state, err := r.copyState(context.Background(), table.Name)
+	if err != nil || state != saved {
+		t.Fatalf("copyState = %+v, %v, want %+v", state, err, saved)
+	}
+
+	sql, args, err = r.copySql(table, state)
+	want = `select * from "t" where "sys_sync_id" > ? order by "sys_sync_id" limit 100`
+	// 超过2^53的sys_sync_id按整数比较
+	if wantArgs := []interface{}{int64(9007199254740993)}; err != nil || sql != want || !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("copySql of %+v = %v, %#v, %v, want %v, %#v", state, sql, args, err, want, wantArgs)
+	}
+}
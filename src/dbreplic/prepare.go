@@ -0,0 +1,178 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"context"
+	"fmt"
+	driver "github.com/go-sql-driver/mysql"
+	"net"
+	"strings"
+)
+
+/*
+准备复制列(prepare):
+1) 检查选中的表是否有sys_sync_id、sys_sync_update_time、sys_sync_create_time列和以sys_sync_update_time开头的索引
+2) 确认后每个表用一条ALTER TABLE增加缺少的列(时间列为微秒精度的TIMESTAMP(6))和索引idx_sys_sync_update_time(sys_sync_update_time, sys_sync_id),
+   可以指定ALGORITHM/LOCK, 或者只生成pt-online-schema-change命令
+3) 已有其它自增列的表不能增加自增的sys_sync_id, 只报告
+*/
+
+const updateTimeIndex = "idx_sys_sync_update_time"
+
+var columnDefinitions = []struct{ name, definition string }{
+	{SyncIdColumn, "BIGINT NOT NULL AUTO_INCREMENT UNIQUE"},
+	{UpdateTimeColumn, "TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)"},
+	{CreateTimeColumn, "TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)"},
+}
+
+// OnlineDdl are the settings of the ALTER TABLE statements of prepare.
+type OnlineDdl struct {
+	Algorithm string `toml:"algorithm"` // 例如INPLACE, 为空时由MySQL选择
+	Lock      string `toml:"lock"`      // 例如NONE
+	PtOsc     bool   `toml:"ptOsc"`     // 不执行ALTER TABLE, 按两边打印带h=/P=的pt-online-schema-change命令
+	PtOscArgs string `toml:"ptOscArgs"` // pt-online-schema-change的其它参数, 例如"--max-load Threads_running=25 --chunk-size 1000"
+}
+
+type TablePlan struct {
+	Table        string
+	Missing      []string // 缺少的列
+	MissingIndex bool
+	Problem      string // 不能增加列的原因
+}
+
+func (plan TablePlan) NeedsAlter() bool {
+	return plan.Problem == "" && (len(plan.Missing) > 0 || plan.MissingIndex)
+}
+
+func (plan TablePlan) String() string {
+	if plan.Problem != "" {
+		return plan.Table + ": " + plan.Problem
+	}
+
+	problems := make([]string, 0)
+	if len(plan.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(plan.Missing, ", "))
+	}
+	if plan.MissingIndex {
+		problems = append(problems, "no index on "+UpdateTimeColumn)
+	}
+	if len(problems) == 0 {
+		return plan.Table + ": ready"
+	}
+
+	return plan.Table + ": " + strings.Join(problems, "; ")
+}
+
+// PlanPrepare checks the replication columns and index of the tables.
+func PlanPrepare(ctx context.Context, db *mydb.Db, tables []string) ([]TablePlan, error) {
+	plans := make([]TablePlan, 0, len(tables))
+	for _, tableName := range tables {
+		table, err := db.Table(ctx, tableName)
+		if err != nil {
+			return nil, err
+		}
+
+		plan := TablePlan{Table: tableName}
+		for _, col := range columnDefinitions {
+			if !table.HasColumn(col.name) {
+				plan.Missing = append(plan.Missing, col.name)
+			}
+		}
+
+		if plan.MissingIndex, err = db.HasIndexOn(ctx, tableName, UpdateTimeColumn); err != nil {
+			return nil, err
+		}
+		plan.MissingIndex = !plan.MissingIndex
+
+		if len(plan.Missing) > 0 && plan.Missing[0] == SyncIdColumn {
+			autoIncrement, err := db.AutoIncrementColumn(ctx, tableName)
+			if err != nil {
+				return nil, err
+			}
+			if autoIncrement != "" {
+				plan.Problem = "can not add the auto increment " + SyncIdColumn + ", " + autoIncrement + " is auto increment"
+			}
+		}
+
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// alterClauses are the ADD COLUMN/ADD INDEX clauses of the plan.
+func alterClauses(dialect mydb.Dialect, plan TablePlan, ddl OnlineDdl) []string {
+	clauses := make([]string, 0)
+	for _, col := range columnDefinitions {
+		for _, missing := range plan.Missing {
+			if missing == col.name {
+				clauses = append(clauses, "ADD COLUMN "+dialect.Quote(col.name)+" "+col.definition)
+			}
+		}
+	}
+	if plan.MissingIndex {
+		clauses = append(clauses, "ADD INDEX "+dialect.Quote(updateTimeIndex)+
+			" ("+dialect.Quote(UpdateTimeColumn)+", "+dialect.Quote(SyncIdColumn)+")")
+	}
+	if ddl.Algorithm != "" {
+		clauses = append(clauses, "ALGORITHM="+ddl.Algorithm)
+	}
+	if ddl.Lock != "" {
+		clauses = append(clauses, "LOCK="+ddl.Lock)
+	}
+
+	return clauses
+}
+
+func AlterSql(dialect mydb.Dialect, plan TablePlan, ddl OnlineDdl) string {
+	return "ALTER TABLE " + dialect.Quote(plan.Table) + " " + strings.Join(alterClauses(dialect, plan, ddl), ", ")
+}
+
+// PtOscCommand makes the pt-online-schema-change command of the plan, the
+// host and port (or socket) are taken from dataSourceName, the account is
+// left for the operator.
+func PtOscCommand(dataSourceName, database string, plan TablePlan, ddl OnlineDdl) (string, error) {
+	dsn, err := driver.ParseDSN(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+
+	target := "D=" + database + ",t=" + plan.Table
+	switch dsn.Net {
+	case "unix":
+		target = "S=" + dsn.Addr + "," + target
+	default:
+		host, port, err := net.SplitHostPort(dsn.Addr)
+		if err != nil {
+			return "", err
+		}
+		target = "h=" + host + ",P=" + port + "," + target
+	}
+
+	ddl.Algorithm, ddl.Lock = "", ""
+	alter := strings.Join(alterClauses(mydb.MySQL, plan, ddl), ", ")
+	command := "pt-online-schema-change --alter '" + alter + "'"
+	if ddl.PtOscArgs != "" {
+		command += " " + ddl.PtOscArgs
+	}
+
+	return command + " --execute " + target, nil
+}
+
+// ApplyPrepare runs the ALTER TABLE of the plans which need it, and returns
+// the altered tables.
+func ApplyPrepare(ctx context.Context, db *mydb.Db, plans []TablePlan, ddl OnlineDdl) ([]string, error) {
+	altered := make([]string, 0)
+	for _, plan := range plans {
+		if !plan.NeedsAlter() {
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, AlterSql(db.Dialect(), plan, ddl)); err != nil {
+			return altered, fmt.Errorf("%v: %v", plan.Table, err)
+		}
+		altered = append(altered, plan.Table)
+	}
+
+	return altered, nil
+}
@@ -0,0 +1,90 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"testing"
+)
+
+var (
+	missingAll = TablePlan{Table: "t", Missing: []string{SyncIdColumn, UpdateTimeColumn, CreateTimeColumn},
+		MissingIndex: true}
+	missingIndex  = TablePlan{Table: "t", MissingIndex: true}
+	ready         = TablePlan{Table: "t"}
+	autoIncrement = TablePlan{Table: "t", Missing: []string{SyncIdColumn},
+		Problem: "can not add the auto increment sys_sync_id, id is auto increment"}
+)
+
+func TestTablePlan(t *testing.T) {
+	tests := []struct {
+		plan       TablePlan
+		needsAlter bool
+		want       string
+	}{
+		{missingAll, true, "t: missing sys_sync_id, sys_sync_update_time, sys_sync_create_time; no index on sys_sync_update_time"},
+		{TablePlan{Table: "t", Missing: []string{CreateTimeColumn}}, true, "t: missing sys_sync_create_time"},
+		{missingIndex, true, "t: no index on sys_sync_update_time"},
+		{ready, false, "t: ready"},
+		{autoIncrement, false, "t: can not add the auto increment sys_sync_id, id is auto increment"},
+	}
+	for _, test := range tests {
+		if got := test.plan.NeedsAlter(); got != test.needsAlter {
+			t.Errorf("%+v NeedsAlter = %v, want %v", test.plan, got, test.needsAlter)
+		}
+		if got := test.plan.String(); got != test.want {
+			t.Errorf("%+v String = %q, want %q", test.plan, got, test.want)
+		}
+	}
+}
+
+func TestAlterSql(t *testing.T) {
+	tests := []struct {
+		plan TablePlan
+		ddl  OnlineDdl
+		want string
+	}{
+		{missingAll, OnlineDdl{}, "ALTER TABLE `t` " +
+			"ADD COLUMN `sys_sync_id` BIGINT NOT NULL AUTO_INCREMENT UNIQUE, " +
+			"ADD COLUMN `sys_sync_update_time` TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6), " +
+			"ADD COLUMN `sys_sync_create_time` TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+			"ADD INDEX `idx_sys_sync_update_time` (`sys_sync_update_time`, `sys_sync_id`)"},
+		// 列按columnDefinitions的顺序增加
+		{TablePlan{Table: "t", Missing: []string{CreateTimeColumn, SyncIdColumn}}, OnlineDdl{Algorithm: "INPLACE", Lock: "NONE"},
+			"ALTER TABLE `t` ADD COLUMN `sys_sync_id` BIGINT NOT NULL AUTO_INCREMENT UNIQUE, " +
+				"ADD COLUMN `sys_sync_create_time` TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), ALGORITHM=INPLACE, LOCK=NONE"},
+		{missingIndex, OnlineDdl{Lock: "SHARED"},
+			"ALTER TABLE `t` ADD INDEX `idx_sys_sync_update_time` (`sys_sync_update_time`, `sys_sync_id`), LOCK=SHARED"},
+	}
+	for _, test := range tests {
+		if got := AlterSql(mydb.MySQL, test.plan, test.ddl); got != test.want {
+			t.Errorf("AlterSql(%+v, %+v) =\n%v\nwant\n%v", test.plan, test.ddl, got, test.want)
+		}
+	}
+}
+
+func TestPtOscCommand(t *testing.T) {
+	index := "--alter 'ADD INDEX `idx_sys_sync_update_time` (`sys_sync_update_time`, `sys_sync_id`)'"
+	tests := []struct {
+		dataSourceName string
+		ddl            OnlineDdl
+		want           string
+	}{
+		{"repl:secret@tcp(db1.example.com:3307)/shop", OnlineDdl{PtOsc: true},
+			"pt-online-schema-change " + index + " --execute h=db1.example.com,P=3307,D=shop,t=t"},
+		// ALGORITHM/LOCK不适用于pt-online-schema-change
+		{"repl:secret@tcp(10.0.0.2:3306)/shop?charset=utf8mb4", OnlineDdl{Algorithm: "INPLACE", Lock: "NONE",
+			PtOsc: true, PtOscArgs: "--chunk-size 1000"},
+			"pt-online-schema-change " + index + " --chunk-size 1000 --execute h=10.0.0.2,P=3306,D=shop,t=t"},
+		{"repl:secret@unix(/var/run/mysqld/mysqld.sock)/shop", OnlineDdl{PtOsc: true},
+			"pt-online-schema-change " + index + " --execute S=/var/run/mysqld/mysqld.sock,D=shop,t=t"},
+	}
+	for _, test := range tests {
+		got, err := PtOscCommand(test.dataSourceName, "shop", missingIndex, test.ddl)
+		if err != nil || got != test.want {
+			t.Errorf("PtOscCommand(%q) = %v, %v, want %v", test.dataSourceName, got, err, test.want)
+		}
+	}
+
+	if _, err := PtOscCommand("repl:secret@tcp(db1.example.com:3307)", "shop", missingIndex, OnlineDdl{}); err == nil {
+		t.Error("PtOscCommand of an invalid data source should fail")
+	}
+}
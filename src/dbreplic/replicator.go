@@ -0,0 +1,327 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"../mynodb"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+增量单向复制:
+1) 复制dbFrom中选中的(见tables.go)、有sys_sync_id和sys_sync_update_time列的表
+2) 没有水位的表先完整复制一次(见copy.go), 然后每个表按(sys_sync_update_time, sys_sync_id)的顺序读取水位之后、dbFrom当前时间减LagSeconds之前修改的行,
+   每批在dbTo的一个事务中按主键(没有主键时按sys_sync_id)upsert
+3) 事务提交后才把水位推进到这一批的最后一行, 中断后重新复制同一批, upsert的结果不变
+4) 每次运行从水位之前LagSeconds秒开始重新读取, 晚于LagSeconds之内提交的行(修改时间早于水位)不会遗漏, 重复的行upsert结果不变
+5) 删除的行不会被复制, 需要复制删除时使用binlog(见binlogsource.go)
+*/
+
+const (
+	SyncIdColumn     = "sys_sync_id"
+	UpdateTimeColumn = "sys_sync_update_time"
+	CreateTimeColumn = "sys_sync_create_time"
+
+	defaultBatchSize  = 1000
+	defaultLagSeconds = 1
+)
+
+type Options struct {
+	DbFrom, DbTo *mydb.Db
+	// State keeps the watermark of every table.
+	State mynodb.StateStore
+	// BatchSize is the row count of each transaction, 1000 by default.
+	BatchSize int
+	// LagSeconds leaves the rows changed in the last seconds to the next
+	// run, the transactions of the same second may not be committed yet,
+	// and each run reads again the rows of LagSeconds before the watermark.
+	// 1 by default.
+	LagSeconds int
+	// Progress is called after each chunk of the initial copy when not nil,
+	// estimated is the row count estimated by information_schema.
+	Progress func(tableName string, copied, estimated int64)
+	// Tables selects the replicated tables, all the tables when nil.
+	Tables *TableFilter
+	// OnTables is called when the replicated tables change when not nil.
+	OnTables func(change TableChange)
+	// Applied is called after each binlog transaction with rows of the
+	// selected tables is committed in dbTo when not nil.
+	Applied func(position BinlogPosition, rows int)
+	// Ddl is called after each DDL of the binlog when not nil, applied is
+	// false when it is not a DDL of a selected table.
+	Ddl func(position BinlogPosition, query string, applied bool)
+}
+
+// Watermark is the position of the last replicated row of a table.
+type Watermark struct {
+	UpdateTime string
+	SyncId     string
+}
+
+func (watermark Watermark) String() string {
+	if watermark.UpdateTime == "" {
+		return "start"
+	}
+	if watermark.SyncId == "" {
+		return watermark.UpdateTime
+	}
+
+	return watermark.UpdateTime + " #" + watermark.SyncId
+}
+
+// after tells whether the watermark is after other in the replication order.
+func (watermark Watermark) after(other Watermark) bool {
+	if watermark.UpdateTime != other.UpdateTime {
+		return watermark.UpdateTime > other.UpdateTime
+	}
+
+	id, _ := strconv.ParseInt(watermark.SyncId, 10, 64)
+	otherId, _ := strconv.ParseInt(other.SyncId, 10, 64)
+	return id > otherId
+}
+
+type TableResult struct {
+	Table     string
+	Created   bool  // 初始复制时在dbTo中创建了表
+	Copied    int64 // 初始复制的行数
+	Rows      int
+	Watermark Watermark
+	Duration  time.Duration
+	Err       error
+}
+
+type Replicator struct {
+	options Options
+	running int32
+	tables  map[string]string // 上一次运行选中的表, 值为"replicated"或"not prepared"
+}
+
+func NewReplicator(options Options) *Replicator {
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.LagSeconds <= 0 {
+		options.LagSeconds = defaultLagSeconds
+	}
+
+	return &Replicator{options: options}
+}
+
+// RunOnce replicates the changed rows of every table once, false is returned
+// when the previous run is not finished yet.
+func (r *Replicator) RunOnce(ctx context.Context) ([]TableResult, bool, error) {
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		return nil, false, nil
+	}
+	defer atomic.StoreInt32(&r.running, 0)
+
+	tables, err := r.selectTables(ctx)
+	if err != nil {
+		return nil, true, err
+	}
+
+	upper, err := r.upperTime(ctx)
+	if err != nil {
+		return nil, true, err
+	}
+
+	results := make([]TableResult, 0, len(tables))
+	for _, tableName := range tables {
+		if err := ctx.Err(); err != nil {
+			return results, true, err
+		}
+
+		startTime := time.Now()
+		result := r.replicateTable(ctx, tableName, upper)
+		result.Duration = time.Now().Sub(startTime)
+		results = append(results, result)
+	}
+
+	return results, true, nil
+}
+
+// upperTime is the time of dbFrom before which the rows are replicated.
+func (r *Replicator) upperTime(ctx context.Context) (string, error) {
+	rows, err := r.options.DbFrom.QueryContext(ctx,
+		"select cast(now(6) - interval ? second as char)", r.options.LagSeconds)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var upper string
+	if rows.Next() {
+		err = rows.Scan(&upper)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return upper, err
+}
+
+func watermarkKey(tableName string) string {
+	return "watermark:" + tableName
+}
+
+// Watermark returns the watermark of the table, which is empty before the
+// first replicated row.
+func (r *Replicator) Watermark(tableName string) (Watermark, error) {
+	watermark := Watermark{}
+	value, err := r.options.State.Get(watermarkKey(tableName))
+	if err != nil || value == "" {
+		return watermark, err
+	}
+
+	err = json.Unmarshal([]byte(value), &watermark)
+	return watermark, err
+}
+
+func (r *Replicator) SetWatermark(tableName string, watermark Watermark) error {
+	value, _ := json.Marshal(watermark)
+	return r.options.State.Set(watermarkKey(tableName), string(value))
+}
+
+func (r *Replicator) replicateTable(ctx context.Context, tableName, upper string) TableResult {
+	result := TableResult{Table: tableName}
+	table, err := r.options.DbFrom.Table(ctx, tableName)
+	if err == nil {
+		result.Watermark, err = r.Watermark(tableName)
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	keyCols, err := r.options.DbFrom.PrimaryKey(ctx, tableName)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if len(keyCols) == 0 {
+		keyCols = []string{SyncIdColumn}
+	}
+
+	if result.Watermark.UpdateTime == "" {
+		if err := r.initialCopy(ctx, table, keyCols, &result); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	// 第一批从水位之前LagSeconds秒开始, 之后按读到的最后一行继续
+	cursor, rescan := result.Watermark, true
+	for {
+		batch, err := r.readBatch(ctx, table, cursor, rescan, upper)
+		if err == nil && len(batch) > 0 {
+			err = r.applyBatch(ctx, tableName, keyCols, batch)
+		}
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if len(batch) == 0 {
+			return result
+		}
+
+		last := batch[len(batch)-1]
+		cursor, rescan = Watermark{last[UpdateTimeColumn], last[SyncIdColumn]}, false
+		if cursor.after(result.Watermark) {
+			if err := r.SetWatermark(tableName, cursor); err != nil {
+				result.Err = err
+				return result
+			}
+			result.Watermark = cursor
+		}
+
+		result.Rows += len(batch)
+		if len(batch) < r.options.BatchSize {
+			return result
+		}
+	}
+}
+
+// readBatch reads the rows after the watermark and before upper, or the rows
+// from LagSeconds before the watermark when rescan is set.
+func (r *Replicator) readBatch(ctx context.Context, table *mydb.Table, watermark Watermark, rescan bool,
+	upper string) ([]map[string]string, error) {
+	sql, args, err := r.batchSql(table, watermark, rescan, upper)
+	if err != nil {
+		return nil, err
+	}
+
+	return readRows(ctx, r.options.DbFrom, sql, args...)
+}
+
+func (r *Replicator) batchSql(table *mydb.Table, watermark Watermark, rescan bool,
+	upper string) (string, []interface{}, error) {
+	query := table.Select().Where(UpdateTimeColumn, "<", upper)
+	t, id := table.Quote(UpdateTimeColumn), table.Quote(SyncIdColumn)
+	switch {
+	case watermark.UpdateTime == "":
+	case rescan:
+		query.Cond(t+" >= ? - interval ? second", watermark.UpdateTime, r.options.LagSeconds)
+	default:
+		query.Cond("("+t+" > ? or ("+t+" = ? and "+id+" > ?))",
+			watermark.UpdateTime, watermark.UpdateTime, table.Infos[SyncIdColumn].Arg(watermark.SyncId))
+	}
+
+	return query.OrderBy(UpdateTimeColumn, SyncIdColumn).Limit(r.options.BatchSize).Sql()
+}
+
+func readRows(ctx context.Context, db *mydb.Db, sql string, args ...interface{}) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]map[string]string, 0)
+	columns, values, scans := mydb.MakeColumnsValues(rows)
+	for rows.Next() {
+		row, err := mydb.ReadRow(rows, columns, values, scans)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// applyBatch upserts the rows in one transaction of dbTo.
+func (r *Replicator) applyBatch(ctx context.Context, tableName string, keyCols []string,
+	batch []map[string]string) error {
+	tx, err := r.options.DbTo.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, row := range batch {
+		if _, err := tx.UpsertRowContext(ctx, tableName, keyCols, row, updateColumns(keyCols, row)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func updateColumns(keyCols []string, row map[string]string) []string {
+	isKey := make(map[string]bool)
+	for _, col := range keyCols {
+		isKey[col] = true
+	}
+
+	cols := make([]string, 0, len(row))
+	for col := range row {
+		if !isKey[col] {
+			cols = append(cols, col)
+		}
+	}
+
+	return cols
+}
@@ -0,0 +1,95 @@
+package dbreplic
+
+import (
+	"../mydb"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWatermarkAfter(t *testing.T) {
+	tests := []struct {
+		watermark, other Watermark
+		want             bool
+	}{
+		{Watermark{"2024-05-01 10:00:00", "1"}, Watermark{}, true},
+		{Watermark{}, Watermark{"2024-05-01 10:00:00", "1"}, false},
+		{Watermark{"2024-05-01 10:00:01", "1"}, Watermark{"2024-05-01 10:00:00", "9"}, true},
+		{Watermark{"2024-05-01 10:00:00", "9"}, Watermark{"2024-05-01 10:00:01", "1"}, false},
+		// 同一时间按sys_sync_id的数值比较
+		{Watermark{"2024-05-01 10:00:00", "10"}, Watermark{"2024-05-01 10:00:00", "9"}, true},
+		{Watermark{"2024-05-01 10:00:00", "9"}, Watermark{"2024-05-01 10:00:00", "10"}, false},
+		{Watermark{"2024-05-01 10:00:00", "9"}, Watermark{"2024-05-01 10:00:00", "9"}, false},
+		// 初始复制后的水位没有sys_sync_id
+		{Watermark{"2024-05-01 10:00:00", "1"}, Watermark{"2024-05-01 10:00:00", ""}, true},
+	}
+	for _, test := range tests {
+		if got := test.watermark.after(test.other); got != test.want {
+			t.Errorf("%v after %v = %v, want %v", test.watermark, test.other, got, test.want)
+		}
+	}
+}
+
+func syncTable() *mydb.Table {
+	return &mydb.Table{
+		Name:    "t",
+		Columns: []string{"id", SyncIdColumn, UpdateTimeColumn},
+		Infos: map[string]mydb.ColumnInfo{
+			"id":             {Name: "id", DataType: "int"},
+			SyncIdColumn:     {Name: SyncIdColumn, DataType: "bigint"},
+			UpdateTimeColumn: {Name: UpdateTimeColumn, DataType: "timestamp"},
+		},
+	}
+}
+
+func TestBatchSql(t *testing.T) {
+	r := NewReplicator(Options{BatchSize: 100, LagSeconds: 2})
+	upper := "2024-05-01 10:00:05"
+	order := ` order by "sys_sync_update_time", "sys_sync_id" limit 100`
+
+	tests := []struct {
+		watermark Watermark
+		rescan    bool
+		wantSql   string
+		wantArgs  []interface{}
+	}{
+		{Watermark{}, true, `select * from "t" where "sys_sync_update_time" < ?` + order, []interface{}{upper}},
+		{Watermark{}, false, `select * from "t" where "sys_sync_update_time" < ?` + order, []interface{}{upper}},
+		// 第一批从水位之前LagSeconds秒开始
+		{Watermark{"2024-05-01 10:00:00", "7"}, true,
+			`select * from "t" where "sys_sync_update_time" < ? and "sys_sync_update_time" >= ? - interval ? second` + order,
+			[]interface{}{upper, "2024-05-01 10:00:00", 2}},
+		{Watermark{"2024-05-01 10:00:00", "7"}, false,
+			`select * from "t" where "sys_sync_update_time" < ? and ("sys_sync_update_time" > ? or ` +
+				`("sys_sync_update_time" = ? and "sys_sync_id" > ?))` + order,
+			[]interface{}{upper, "2024-05-01 10:00:00", "2024-05-01 10:00:00", int64(7)}},
+	}
+	for _, test := range tests {
+		sql, args, err := r.batchSql(syncTable(), test.watermark, test.rescan, upper)
+		if err != nil || sql != test.wantSql || !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("batchSql(%v, %v) = %v, %#v, %v, want %v, %#v", test.watermark, test.rescan, sql, args, err,
+				test.wantSql, test.wantArgs)
+		}
+	}
+}
+
+func TestUpdateColumns(t *testing.T) {
+	row := map[string]string{"a": "1", "b": "2", "c": "3", SyncIdColumn: "4"}
+	tests := []struct {
+		keyCols []string
+		want    []string
+	}{
+		{[]string{"a"}, []string{"b", "c", SyncIdColumn}},
+		{[]string{"a", "b"}, []string{"c", SyncIdColumn}},
+		// 没有主键时按sys_sync_id upsert
+		{[]string{SyncIdColumn}, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c", SyncIdColumn}, []string{}},
+	}
+	for _, test := range tests {
+		got := updateColumns(test.keyCols, row)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("updateColumns(%q) = %q, want %q", test.keyCols, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package dbreplic
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+选择复制的表:
+1) 规则按顺序匹配, 第一个匹配的规则决定表是否复制: "+tr_f_*"包含, "-tr_f_tmp*"排除, 没有前缀时为包含
+2) 模式是glob(path.Match), 或者用斜杠括起来的正则表达式, 例如"-/^log_\d{6}$/"
+3) excludeTables相当于放在最前面的排除规则
+4) 没有规则匹配时, 有包含规则则不复制, 只有排除规则则复制
+5) 每次运行都从information_schema.tables重新读取表, 新增的表下一次运行就开始复制, 删除或不再选中的表只打印出来, 水位保留
+*/
+
+type tableRule struct {
+	include bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (rule tableRule) match(tableName string) bool {
+	if rule.re != nil {
+		return rule.re.MatchString(tableName)
+	}
+
+	matched, _ := path.Match(rule.pattern, tableName)
+	return matched
+}
+
+// TableFilter selects the tables by the ordered include and exclude rules,
+// a nil filter selects all the tables.
+type TableFilter struct {
+	rules    []tableRule
+	includes bool
+}
+
+// NewTableFilter parses the rules like "+tr_f_*" and "-/^tmp_\d+$/", the
+// excludes are the patterns excluded before the rules.
+func NewTableFilter(rules, excludes []string) (*TableFilter, error) {
+	filter := &TableFilter{}
+	for _, exclude := range excludes {
+		if err := filter.add(false, exclude); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, rule := range rules {
+		include := true
+		switch {
+		case strings.HasPrefix(rule, "+"):
+			rule = rule[1:]
+		case strings.HasPrefix(rule, "-"):
+			include, rule = false, rule[1:]
+		}
+		if err := filter.add(include, rule); err != nil {
+			return nil, err
+		}
+		filter.includes = filter.includes || include
+	}
+
+	return filter, nil
+}
+
+func (filter *TableFilter) add(include bool, pattern string) error {
+	rule := tableRule{include: include, pattern: pattern}
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("table pattern %v: %v", pattern, err)
+		}
+		rule.re = re
+	} else if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return fmt.Errorf("table pattern %q: bad pattern", pattern)
+	}
+
+	filter.rules = append(filter.rules, rule)
+	return nil
+}
+
+func (filter *TableFilter) Match(tableName string) bool {
+	if filter == nil {
+		return true
+	}
+
+	for _, rule := range filter.rules {
+		if rule.match(tableName) {
+			return rule.include
+		}
+	}
+
+	return !filter.includes
+}
+
+// Filter returns the selected tables in the same order.
+func (filter *TableFilter) Filter(tables []string) []string {
+	result := make([]string, 0, len(tables))
+	for _, table := range tables {
+		if filter.Match(table) {
+			result = append(result, table)
+		}
+	}
+
+	return result
+}
+
+// TableChange is the change of the replicated tables since the last run,
+// Added are all the tables on the first run.
+type TableChange struct {
+	Added       []string
+	Removed     []string // 删除或不再选中的表
+	NotPrepared []string // 新选中但没有sys_sync_id或sys_sync_update_time列的表
+}
+
+func (change TableChange) Empty() bool {
+	return len(change.Added) == 0 && len(change.Removed) == 0 && len(change.NotPrepared) == 0
+}
+
+// selectTables reads the tables of dbFrom, and returns the selected ones with
+// the replication columns.
+func (r *Replicator) selectTables(ctx context.Context) ([]string, error) {
+	tables, err := r.options.DbFrom.Tables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prepared, err := r.options.DbFrom.TablesWithColumns(ctx, SyncIdColumn, UpdateTimeColumn)
+	if err != nil {
+		return nil, err
+	}
+	isPrepared := make(map[string]bool)
+	for _, table := range prepared {
+		isPrepared[table] = true
+	}
+
+	selected := make(map[string]bool)
+	change := TableChange{}
+	result := make([]string, 0)
+	for _, table := range r.options.Tables.Filter(tables) {
+		selected[table] = true
+		if !isPrepared[table] {
+			if r.tables[table] != "not prepared" {
+				change.NotPrepared = append(change.NotPrepared, table)
+			}
+			continue
+		}
+
+		if r.tables[table] != "replicated" {
+			change.Added = append(change.Added, table)
+		}
+		result = append(result, table)
+	}
+
+	for table := range r.tables {
+		if !selected[table] {
+			change.Removed = append(change.Removed, table)
+		}
+	}
+	sort.Strings(change.Removed)
+
+	r.tables = make(map[string]string)
+	for table := range selected {
+		r.tables[table] = "not prepared"
+	}
+	for _, table := range result {
+		r.tables[table] = "replicated"
+	}
+
+	if !change.Empty() && r.options.OnTables != nil {
+		r.options.OnTables(change)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package dbreplic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTableFilter(t *testing.T) {
+	tables := []string{"tr_f_user", "tr_f_tmp_user", "tr_f_order", "log_202405", "log_x", "tmp_1", "config"}
+
+	tests := []struct {
+		rules, excludes []string
+		want            []string
+	}{
+		{nil, nil, tables},
+		{[]string{"+tr_f_*"}, nil, []string{"tr_f_user", "tr_f_tmp_user", "tr_f_order"}},
+		// 第一个匹配的规则生效
+		{[]string{"-tr_f_tmp*", "+tr_f_*"}, nil, []string{"tr_f_user", "tr_f_order"}},
+		{[]string{"+tr_f_*", "-tr_f_tmp*"}, nil, []string{"tr_f_user", "tr_f_tmp_user", "tr_f_order"}},
+		// 没有前缀时为包含
+		{[]string{"config"}, nil, []string{"config"}},
+		// 只有排除规则时, 没有匹配的表复制
+		{[]string{`-/^log_\d{6}$/`}, nil, []string{"tr_f_user", "tr_f_tmp_user", "tr_f_order", "log_x", "tmp_1", "config"}},
+		{[]string{"+/^log_/"}, []string{"log_x"}, []string{"log_202405"}},
+		{nil, []string{"tmp_*", "tr_f_*"}, []string{"log_202405", "log_x", "config"}},
+	}
+	for _, test := range tests {
+		filter, err := NewTableFilter(test.rules, test.excludes)
+		if err != nil {
+			t.Errorf("NewTableFilter(%q, %q): %v", test.rules, test.excludes, err)
+			continue
+		}
+		if got := filter.Filter(tables); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Filter(%q, %q) = %q, want %q", test.rules, test.excludes, got, test.want)
+		}
+	}
+
+	var filter *TableFilter
+	if !filter.Match("any") {
+		t.Error("nil filter should select all the tables")
+	}
+
+	for _, rules := range [][]string{{"+/[/"}, {"+tr_f_["}, {"-"}} {
+		if _, err := NewTableFilter(rules, nil); err == nil {
+			t.Errorf("NewTableFilter(%q) should fail", rules)
+		}
+	}
+}
@@ -1,164 +1,330 @@
 package main
 
 import (
+	"./dbsync"
 	"./mydb"
 	"./mynodb"
 	"./myutil"
+	"context"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	_ "github.com/go-sql-driver/mysql"
+	"net/http"
 	"os"
-	"reflect"
-	"time"
+	"os/signal"
+	"strings"
 )
 
-const PK = "_PK_"
-const PK_COL = "_PK_COL_"
+// dbsync [dbsync.toml]
+// dbsync check [dbsync.toml]
+// dbsync runs [dbsync.toml]
+// dbsync rollback <run-id> [dbsync.toml]
+// dbsync daemon [dbsync.toml]
+// dbsync review [dbsync.toml]
+// dbsync objects [dbsync.toml]
+// dbsync changelog-setup [dbsync.toml]
+// dbsync changelog-uninstall [dbsync.toml]
+// dbsync history [dbsync.toml]
+// dbsync history-html [dbsync.toml]
+// dbsync objects-script <Db1|Db2> [dbsync.toml]
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			daemon(readConfig(configPath(2)))
+			return
+		case "review":
+			review(readConfig(configPath(2)))
+			return
+		case "history":
+			history(readConfig(configPath(2)), false)
+			return
+		case "history-html":
+			history(readConfig(configPath(2)), true)
+			return
+		case "changelog-setup":
+			changelog(readConfig(configPath(2)), true)
+			return
+		case "changelog-uninstall":
+			changelog(readConfig(configPath(2)), false)
+			return
+		case "objects":
+			objects(readConfig(configPath(2)))
+			return
+		case "objects-script":
+			if len(os.Args) < 3 || (os.Args[2] != "Db1" && os.Args[2] != "Db2") {
+				fmt.Println("Usage: dbsync objects-script <Db1|Db2> [dbsync.toml]")
+				os.Exit(1)
+			}
+			objectsScript(os.Args[2], readConfig(configPath(3)))
+			return
+		case "check":
+			check(configPath(2))
+			return
+		case "runs":
+			listRuns(readConfig(configPath(2)))
+			return
+		case "rollback":
+			if len(os.Args) < 3 {
+				fmt.Println("Usage: dbsync rollback <run-id> [dbsync.toml]")
+				os.Exit(1)
+			}
+			rollback(os.Args[2], readConfig(configPath(3)))
+			return
+		}
+	}
+
+	dbSyncConfig := readConfig(configPath(1))
+	db1, db2 := openDbs(dbSyncConfig)
+	defer db1.Close()
+	defer db2.Close()
+
+	printTimeZones(db1, db2)
+	options, closeState := makeOptions(dbSyncConfig, db1, db2)
+	defer closeState()
 
-type DbSyncConfig struct {
-	Db1, Db2   string
-	SyncTables []string
+	undo, err := dbsync.OpenUndoJournal(dbSyncConfig.UndoPath())
+	myutil.CheckErr(err)
+	defer undo.Close()
+	options.Undo = undo
+	fmt.Println("Run id " + undo.RunId)
+
+	notifier := dbsync.NewNotifier(dbSyncConfig.Notify, undo.RunId)
+	options.Handler = dbsync.Handlers(&dbsync.ConsoleHandler{}, notifier)
+	if dbSyncConfig.HistoryFile != "" {
+		recorder := dbsync.NewHistoryStore(dbSyncConfig.HistoryFile).Recorder(undo.RunId, dbSyncConfig.Notify.SampleKeys)
+		options.Handler = dbsync.Handlers(options.Handler, recorder)
+	}
+
+	syncer, err := dbsync.NewSyncer(options)
+	if err == nil {
+		err = syncer.Run(interruptContext())
+	}
+	notifier.Finish(err)
+	myutil.CheckErr(err)
 }
 
-type SyncParam struct {
-	db1             *mydb.Db
-	db2             *mydb.Db
-	tableName       string
-	nodb            *mynodb.Nodb
-	rowChan1        chan map[string]string
-	rowChan2        chan map[string]string
-	diffRowsCount   int
-	leftMergedRows  int
-	rightMergedRows int
+// openDbs opens both sides, with the UTC time zone and utf8mb4 when Normalize is set.
+func openDbs(dbSyncConfig dbsync.Config) (*mydb.Db, *mydb.Db) {
+	dataSource1, dataSource2 := dbSyncConfig.DataSources()
+	return mydb.GetDb(dataSource1), mydb.GetDb(dataSource2)
 }
 
-func main() {
-	dbSyncConfig := readConfig()
-	db1 := mydb.GetDb(dbSyncConfig.Db1)
+func printTimeZones(db1, db2 *mydb.Db) {
+	for i, db := range []*mydb.Db{db1, db2} {
+		global, session, offset, err := db.TimeZone(context.Background())
+		myutil.CheckErr(err)
+		fmt.Printf("Db%v time zone %v, session %v (%v)\n", i+1, global, session, offset)
+	}
+}
+
+// makeOptions opens the state store when StateDir is set, the returned func
+// closes it.
+func makeOptions(dbSyncConfig dbsync.Config, db1, db2 *mydb.Db) (dbsync.Options, func()) {
+	options := dbSyncConfig.Options(db1, db2)
+	if dbSyncConfig.StateDir == "" {
+		return options, func() {}
+	}
+
+	state, err := mynodb.OpenStore(dbSyncConfig.StateBackend, dbSyncConfig.StateDir)
+	myutil.CheckErr(err)
+	options.State = state
+	return options, func() { state.Close() }
+}
+
+func daemon(dbSyncConfig dbsync.Config) {
+	db1, db2 := openDbs(dbSyncConfig)
 	defer db1.Close()
-	db2 := mydb.GetDb(dbSyncConfig.Db2)
 	defer db2.Close()
 
-	nodb, tempDir, _ := mynodb.OpenTemp()
-	defer os.RemoveAll(tempDir)
-
-	for _, tableName := range dbSyncConfig.SyncTables {
-		rowChan1 := make(chan map[string]string)
-		rowChan2 := make(chan map[string]string)
-		syncConf := SyncParam{db1, db2, tableName, nodb, rowChan1, rowChan2, 0, 0, 0}
+	options, closeState := makeOptions(dbSyncConfig, db1, db2)
+	defer closeState()
 
-		go syncConf.walkDb1()
-		syncConf.mergeToDb2()
+	d, err := dbsync.NewDaemon(dbSyncConfig, options)
+	myutil.CheckErr(err)
 
-		go syncConf.walkDb2()
-		syncConf.mergeToDb1()
+	ctx := interruptContext()
+	d.Start(ctx)
+	if dbSyncConfig.HttpListen != "" {
+		go func() {
+			myutil.CheckErr(http.ListenAndServe(dbSyncConfig.HttpListen, d))
+		}()
 	}
+
+	d.Wait()
 }
 
-func readConfig() DbSyncConfig {
-	fpath := "dbsync.toml"
-	if len(os.Args) > 1 {
-		fpath = os.Args[1]
+// review asks the operator row by row, and applies the choices at the end.
+func review(dbSyncConfig dbsync.Config) {
+	for tableName, tableConfig := range dbSyncConfig.Tables {
+		if tableConfig.Db1Shard != nil || tableConfig.Db2Shard != nil {
+			fmt.Println("review does not support the sharded table " + tableName)
+			os.Exit(1)
+		}
 	}
 
-	dbSyncConfig := DbSyncConfig{}
-	if _, err := toml.DecodeFile(fpath, &dbSyncConfig); err != nil {
-		myutil.CheckErr(err)
+	db1, db2 := openDbs(dbSyncConfig)
+	defer db1.Close()
+	defer db2.Close()
+
+	reviewer := dbsync.NewReviewer(db1, db2, os.Stdin, os.Stdout)
+	options, closeState := makeOptions(dbSyncConfig, db1, db2)
+	defer closeState()
+	options.ReadOnly = true
+	options.Handler = reviewer
+
+	ctx := interruptContext()
+	syncer, err := dbsync.NewSyncer(options)
+	myutil.CheckErr(err)
+	myutil.CheckErr(syncer.Run(ctx))
+
+	actions, err := reviewer.Review(ctx)
+	myutil.CheckErr(err)
+	if actions == nil {
+		fmt.Println("Nothing applied")
+		return
 	}
 
-	return dbSyncConfig
+	undo, err := dbsync.OpenUndoJournal(dbSyncConfig.UndoPath())
+	myutil.CheckErr(err)
+	defer undo.Close()
+
+	applied, err := reviewer.Apply(ctx, actions, undo)
+	myutil.CheckErr(err)
+	fmt.Printf("Applied %v rows\n", applied)
 }
 
-func (syncParam *SyncParam) walkDb2() {
-	rows := syncParam.db2.Query("select * from " + syncParam.tableName)
-	defer rows.Close()
-	defer close(syncParam.rowChan2)
+// history prints the divergence of every table over the runs, or the trend page.
+func history(dbSyncConfig dbsync.Config, html bool) {
+	if dbSyncConfig.HistoryFile == "" {
+		fmt.Println("HistoryFile is not configured")
+		os.Exit(1)
+	}
 
-	pkCol, _ := syncParam.nodb.Get(PK_COL)
-	columns, values, scans := mydb.MakeColumnsValues(rows)
+	records, err := dbsync.NewHistoryStore(dbSyncConfig.HistoryFile).Read()
+	myutil.CheckErr(err)
 
-	for rows.Next() {
-		row := mydb.ScanRow(rows, columns, values, scans)
-		if !syncParam.nodb.Exists(row[pkCol]) {
-			syncParam.rowChan2 <- row
-		}
+	trends := dbsync.Trends(records)
+	if html {
+		myutil.CheckErr(dbsync.WriteTrendsHTML(os.Stdout, trends))
+		return
 	}
+	dbsync.PrintTrends(os.Stdout, trends)
 }
 
-func (syncParam *SyncParam) walkDb1() {
-	rows := syncParam.db1.Query("select * from " + syncParam.tableName)
-	defer rows.Close()
-	defer close(syncParam.rowChan1)
-
-	columns, values, scans := mydb.MakeColumnsValues(rows)
+// changelog installs or uninstalls the changelog triggers on both sides.
+func changelog(dbSyncConfig dbsync.Config, setup bool) {
+	db1, db2 := openDbs(dbSyncConfig)
+	defer db1.Close()
+	defer db2.Close()
 
-	for rows.Next() {
-		row := mydb.ScanRow(rows, columns, values, scans)
+	ctx := interruptContext()
+	for _, side := range []struct {
+		name string
+		db   *mydb.Db
+	}{{"Db1", db1}, {"Db2", db2}} {
+		if setup {
+			myutil.CheckErr(dbsync.SetupChangelog(ctx, side.db, dbSyncConfig, side.name))
+			fmt.Println("Installed the changelog triggers on " + side.name)
+			continue
+		}
 
-		row[PK] = string(values[0])
-		row[PK_COL] = columns[0]
-		syncParam.rowChan1 <- row
+		dropped, err := dbsync.UninstallChangelog(ctx, side.db)
+		myutil.CheckErr(err)
+		fmt.Printf("Dropped %v triggers and %v on %v\n", len(dropped), dbsync.ChangelogTable, side.name)
 	}
 }
 
-func (syncParam *SyncParam) mergeToDb1() {
-	startTime := time.Now()
-	fmt.Println("Start to merge left " + syncParam.tableName)
-	for row1 := range syncParam.rowChan2 {
-		syncParam.db1.InsertRow(syncParam.tableName, row1)
-		syncParam.leftMergedRows += 1
+// objects prints the differing procedures, functions, triggers and views.
+func objects(dbSyncConfig dbsync.Config) {
+	db1, db2 := openDbs(dbSyncConfig)
+	defer db1.Close()
+	defer db2.Close()
+
+	diffs, err := dbsync.CompareObjects(interruptContext(), db1, db2)
+	myutil.CheckErr(err)
+
+	for _, diff := range diffs {
+		fmt.Printf("%v %v %v\n", strings.ToLower(diff.Type), diff.Name, diff.Kind)
+		if diff.Kind == dbsync.ReviewDiff {
+			fmt.Print(diff.UnifiedDiff())
+		}
 	}
+	fmt.Printf("%v objects differ\n", len(diffs))
+}
 
-	costTime := time.Now().Sub(startTime)
-	fmt.Printf("Merged left %v with %v rows in %v\n",
-		syncParam.tableName, syncParam.leftMergedRows, costTime)
+// objectsScript prints the script which makes the target side the same as
+// the other side.
+func objectsScript(target string, dbSyncConfig dbsync.Config) {
+	db1, db2 := openDbs(dbSyncConfig)
+	defer db1.Close()
+	defer db2.Close()
+
+	diffs, err := dbsync.CompareObjects(interruptContext(), db1, db2)
+	myutil.CheckErr(err)
+	fmt.Print(dbsync.AlignScript(diffs, target))
 }
 
-func (syncParam *SyncParam) mergeToDb2() {
-	startTime := time.Now()
-	fmt.Println("Start to merge right " + syncParam.tableName)
-	for row1 := range syncParam.rowChan1 {
-		syncParam.mergeRowToDb2(row1)
+func check(fpath string) {
+	report := dbsync.Check(interruptContext(), fpath)
+	report.Print(os.Stdout)
+	if report.Failed() > 0 {
+		os.Exit(1)
 	}
 
-	costTime := time.Now().Sub(startTime)
-	fmt.Printf("Merged right %v with %v rows in %v\n",
-		syncParam.tableName, syncParam.rightMergedRows, costTime)
+	fmt.Println("OK")
 }
 
-func (syncParam *SyncParam) mergeRowToDb2(row1 map[string]string) {
-	pk := row1[PK]
-	delete(row1, PK)
-	pkCol := row1[PK_COL]
-	delete(row1, PK_COL)
-	sql := "select * from " + syncParam.tableName + " where " + pkCol + " = ? limit 1"
-	rows := syncParam.db2.Query(sql, pk)
-	defer rows.Close()
+func listRuns(dbSyncConfig dbsync.Config) {
+	runs, err := dbsync.ListUndoRuns(dbSyncConfig.UndoPath())
+	myutil.CheckErr(err)
+
+	for _, run := range runs {
+		rolledBack := ""
+		if run.RolledBack {
+			rolledBack = " rolled back"
+		}
+		fmt.Printf("%v inserts:%v updates:%v deletes:%v failed:%v%v\n", run.RunId, run.Inserts, run.Updates, run.Deletes,
+			run.Failed, rolledBack)
+	}
+}
 
-	syncParam.nodb.Set(PK_COL, pkCol)
+func rollback(runId string, dbSyncConfig dbsync.Config) {
+	db1, db2 := openDbs(dbSyncConfig)
+	defer db1.Close()
+	defer db2.Close()
 
-	columns, values, scans := mydb.MakeColumnsValues(rows)
-	if rows.Next() {
-		row2 := mydb.ScanRow(rows, columns, values, scans)
-		syncParam.compareRow(pk, columns, row1, row2)
-	} else {
-		syncParam.db2.InsertRow(syncParam.tableName, row1)
-		syncParam.nodb.Set(pk, "1")
-		syncParam.rightMergedRows += 1
+	result, err := dbsync.Rollback(interruptContext(), dbSyncConfig.UndoPath(), runId, db1, db2)
+	fmt.Printf("Rolled back %v rows of run %v\n", result.Reverted, runId)
+	for _, conflict := range result.Conflicts {
+		fmt.Println("Skipped changed row " + conflict)
 	}
+	myutil.CheckErr(err)
 }
 
-func (syncParam *SyncParam) compareRow(pk string, columns []string, row1, row2 map[string]string) {
-	if reflect.DeepEqual(row1, row2) {
-		syncParam.nodb.Set(pk, "2")
-		return
+func configPath(argIndex int) string {
+	if len(os.Args) > argIndex {
+		return os.Args[argIndex]
 	}
 
-	syncParam.nodb.Set(pk, "3")
-	syncParam.diffRowsCount += 1
+	return "dbsync.toml"
+}
+
+func readConfig(fpath string) dbsync.Config {
+	dbSyncConfig, err := dbsync.ReadConfig(fpath)
+	myutil.CheckErr(err)
+
+	return dbSyncConfig
+}
+
+// interruptContext is canceled on Ctrl-C, so that the current table stops cleanly.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
 
-	msg := fmt.Sprintf("%v<<<%v\n%v>>>%v\n",
-		syncParam.diffRowsCount+1, myutil.RowToString(columns, row1),
-		syncParam.diffRowsCount+1, myutil.RowToString(columns, row2))
-	fmt.Printf(msg)
+	return ctx
 }
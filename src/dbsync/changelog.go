@@ -0,0 +1,269 @@
+package dbsync
+
+import (
+	"../mydb"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+/*
+基于触发器的变更捕获(Changelog = true):
+1) changelog-setup在两边创建_dbsync_changelog表, 并为每个同步表(分表时为每个分表)创建AFTER INSERT/UPDATE/DELETE触发器,
+   把变化的主键和操作(I/U/D)写入该表, 修改主键时旧主键记为D
+2) 运行时只比较两边changelog中的主键, 表同步成功后按id删除读到的记录. 不按id保存检查点,
+   自增id按分配顺序而不是提交顺序可见, 较小的id可能在读取之后才提交, 留到下一次运行
+3) 主键在一边最后的记录是D且该行已不存在时, 在另一边也删除该行, 而不是从另一边补回.
+   OneWay模式下不传播删除: Db2中删除的行按Db1补回, Db2的changelog只用于找出需要按Db1更新的行
+4) dbsync自己的写入也会被记录, 下一次运行时两边一致, 不再写入
+5) changelog-uninstall删除所有_dbsync_开头的触发器和_dbsync_changelog表
+*/
+
+const ChangelogTable = "_dbsync_changelog"
+
+const changelogPrefix = "_dbsync_"
+
+var changelogEvents = []struct{ event, suffix string }{
+	{"INSERT", "ai"},
+	{"UPDATE", "au"},
+	{"DELETE", "ad"},
+}
+
+// changeSet is the keys changed on both sides.
+type changeSet struct {
+	keys       []string
+	ops1, ops2 map[string]string // 每个主键在一边最后的操作
+	ids1, ids2 []int64           // 读到的changelog记录, 同步成功后删除
+}
+
+// deleted tells whether the key was last deleted on the side.
+func (changes *changeSet) deleted(side, pk string) bool {
+	if changes == nil {
+		return false
+	}
+	if side == "Db1" {
+		return changes.ops1[pk] == "D"
+	}
+
+	return changes.ops2[pk] == "D"
+}
+
+// SetupChangelog creates the changelog table and the triggers of the sync
+// tables on one side, the existing triggers of dbsync are replaced.
+func SetupChangelog(ctx context.Context, db *mydb.Db, config Config, side string) error {
+	_, err := db.ExecContext(ctx, "create table if not exists "+db.Dialect().Quote(ChangelogTable)+" ("+
+		"id bigint unsigned not null auto_increment primary key, "+
+		"table_name varchar(64) not null, "+
+		"pk varchar(255) not null, "+
+		"op char(1) not null, "+
+		"created_at timestamp not null default current_timestamp, "+
+		"key idx_table_id (table_name, id))")
+	if err != nil {
+		return err
+	}
+
+	for _, logicalName := range config.SyncTables {
+		for _, tableName := range physicalTables(logicalName, config.Tables[logicalName], side) {
+			table, err := db.Table(ctx, tableName)
+			if err != nil {
+				return err
+			}
+			pk, err := db.PrimaryKey(ctx, tableName)
+			if err != nil {
+				return err
+			}
+			if len(pk) != 1 {
+				return fmt.Errorf("%v: a single column primary key is needed, found %v", tableName, pk)
+			}
+
+			for _, statement := range changelogTriggers(db.Dialect(), logicalName, table, pk[0]) {
+				if _, err := db.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("%v: %v", tableName, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func changelogTriggers(dialect mydb.Dialect, logicalName string, table *mydb.Table, pkCol string) []string {
+	pk := dialect.Quote(pkCol)
+	insert := func(row, op string) string {
+		return "insert into " + dialect.Quote(ChangelogTable) + " (table_name, pk, op) values ('" +
+			strings.Replace(logicalName, "'", "''", -1) + "', " + row + "." + pk + ", '" + op + "');"
+	}
+
+	statements := make([]string, 0, 2*len(changelogEvents))
+	for _, e := range changelogEvents {
+		name := dialect.Quote(changelogTriggerName(table.Name, e.suffix))
+		var body string
+		switch e.event {
+		case "INSERT":
+			body = insert("NEW", "I")
+		case "UPDATE":
+			body = "if NEW." + pk + " <> OLD." + pk + " then " + insert("OLD", "D") + " end if; " + insert("NEW", "U")
+		case "DELETE":
+			body = insert("OLD", "D")
+		}
+
+		statements = append(statements, "drop trigger if exists "+name,
+			"create trigger "+name+" after "+e.event+" on "+dialect.Quote(table.Name)+
+				" for each row begin "+body+" end")
+	}
+
+	return statements
+}
+
+// changelogTriggerName is _dbsync_<table>_ai/au/ad, the long names are cut
+// to 64 chars with a hash.
+func changelogTriggerName(tableName, suffix string) string {
+	name := changelogPrefix + tableName + "_" + suffix
+	if len(name) <= 64 {
+		return name
+	}
+
+	return fmt.Sprintf("%v_%08x", name[:55], crc32.ChecksumIEEE([]byte(name)))
+}
+
+// UninstallChangelog drops the triggers of dbsync and the changelog table,
+// and returns the dropped triggers.
+func UninstallChangelog(ctx context.Context, db *mydb.Db) ([]string, error) {
+	triggers, err := db.ObjectNames(ctx, "TRIGGER")
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := make([]string, 0)
+	for _, trigger := range triggers {
+		if !strings.HasPrefix(trigger, changelogPrefix) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "drop trigger if exists "+db.Dialect().Quote(trigger)); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, trigger)
+	}
+
+	_, err = db.ExecContext(ctx, "drop table if exists "+db.Dialect().Quote(ChangelogTable))
+	return dropped, err
+}
+
+// readChanges reads the changelog of both sides.
+func (syncParam *tableSync) readChanges() (*changeSet, error) {
+	changes := &changeSet{}
+	seen := make(map[string]bool)
+	var err error
+	changes.ops1, changes.ids1, err = syncParam.readChangelog(syncParam.read1, syncParam.db1.Dialect(), seen, changes)
+	if err != nil {
+		return nil, err
+	}
+	changes.ops2, changes.ids2, err = syncParam.readChangelog(syncParam.read2, syncParam.db2.Dialect(), seen, changes)
+	return changes, err
+}
+
+func (syncParam *tableSync) readChangelog(db querier, dialect mydb.Dialect, seen map[string]bool,
+	changes *changeSet) (map[string]string, []int64, error) {
+	rows, err := db.QueryContext(syncParam.ctx, "select id, pk, op from "+dialect.Quote(ChangelogTable)+
+		" where table_name = ? order by id", syncParam.tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	ops := make(map[string]string)
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		var pk, op string
+		if err := rows.Scan(&id, &pk, &op); err != nil {
+			return nil, nil, err
+		}
+
+		ids = append(ids, id)
+		ops[pk] = op
+		if !seen[pk] {
+			seen[pk] = true
+			changes.keys = append(changes.keys, pk)
+		}
+	}
+
+	return ops, ids, rows.Err()
+}
+
+// commitChanges deletes the processed entries by their ids, the entries
+// written after they are read are kept for the next run.
+func (syncParam *tableSync) commitChanges() error {
+	changes := syncParam.changes
+	for _, c := range []struct {
+		db  *mydb.Db
+		ids []int64
+	}{{syncParam.db1, changes.ids1}, {syncParam.db2, changes.ids2}} {
+		for start := 0; start < len(c.ids); start += syncParam.options.PageSize {
+			end := start + syncParam.options.PageSize
+			if end > len(c.ids) {
+				end = len(c.ids)
+			}
+
+			args := make([]interface{}, 0, end-start)
+			for _, id := range c.ids[start:end] {
+				args = append(args, id)
+			}
+
+			_, err := c.db.ExecContext(syncParam.ctx, "delete from "+c.db.Dialect().Quote(ChangelogTable)+
+				" where id in (?"+strings.Repeat(",?", len(args)-1)+")", args...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// walkKeys sends the rows of the changed keys to rowChan page by page.
+func (syncParam *tableSync) walkKeys(db querier, table *mydb.Table, rowChan chan map[string]string,
+	accept func(pk string) bool) error {
+	keys := syncParam.changes.keys
+	for start := 0; start < len(keys); start += syncParam.options.PageSize {
+		end := start + syncParam.options.PageSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		args := make([]interface{}, 0, end-start)
+		for _, key := range keys[start:end] {
+			args = append(args, table.Infos[syncParam.pkCol].Arg(key))
+		}
+
+		page, err := syncParam.readPage(db, table.Select().In(syncParam.pkCol, args...).OrderBy(syncParam.pkCol))
+		if err != nil {
+			return err
+		}
+
+		if err := syncParam.sendPage(page, rowChan, accept); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteRow deletes the row which is deleted on the other side.
+func (syncParam *tableSync) deleteRow(db *mydb.Db, side string, table *mydb.Table, pkCol string,
+	row map[string]string) error {
+	if !syncParam.options.ReadOnly {
+		entry := UndoEntry{Side: side, Table: table.Name, PkCol: pkCol, Pk: row[pkCol], Op: undoDelete, Before: row}
+		if err := syncParam.recordUndo(entry); err != nil {
+			return err
+		}
+		if _, err := db.DeleteRowContext(syncParam.ctx, table.Name, pkCol, table.Infos[pkCol].Arg(row[pkCol])); err != nil {
+			syncParam.failUndo(entry)
+			return err
+		}
+	}
+
+	syncParam.result.Deleted += 1
+	return nil
+}
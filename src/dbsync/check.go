@@ -0,0 +1,353 @@
+package dbsync
+
+import (
+	"../myconf"
+	"../mydb"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var requiredPrivileges = []string{"SELECT", "INSERT", "UPDATE"}
+
+type CheckItem struct {
+	Name string
+	Err  error
+}
+
+type CheckReport struct {
+	Items []CheckItem
+}
+
+func (report *CheckReport) add(name string, err error) bool {
+	report.Items = append(report.Items, CheckItem{name, err})
+	return err == nil
+}
+
+func (report CheckReport) Failed() int {
+	failed := 0
+	for _, item := range report.Items {
+		if item.Err != nil {
+			failed += 1
+		}
+	}
+
+	return failed
+}
+
+func (report CheckReport) Print(w io.Writer) {
+	for _, item := range report.Items {
+		if item.Err == nil {
+			fmt.Fprintf(w, "[PASS] %v\n", item.Name)
+		} else {
+			fmt.Fprintf(w, "[FAIL] %v: %v\n", item.Name, item.Err)
+		}
+	}
+
+	fmt.Fprintf(w, "%v checks, %v failed\n", len(report.Items), report.Failed())
+}
+
+// Check validates the config file, and checks that both databases are
+// reachable and every sync table is usable on both sides.
+func Check(ctx context.Context, fpath string) CheckReport {
+	report := CheckReport{}
+	config, err := readConfigStrict(fpath)
+	if report.add("config "+fpath, err) {
+		report.add("config values", config.Validate())
+	}
+	if err != nil {
+		return report
+	}
+
+	db1, db2 := config.DataSources()
+	report.checkDb(ctx, "Db1", db1, config)
+	report.checkDb(ctx, "Db2", db2, config)
+	report.checkNormalize(ctx, config)
+	return report
+}
+
+// checkNormalize compares the time zones and the column charsets and
+// collations of both sides, the differences fail unless Normalize is set.
+func (report *CheckReport) checkNormalize(ctx context.Context, config Config) {
+	db1, err := mydb.OpenDb(config.Db1)
+	if err != nil {
+		return
+	}
+	defer db1.Close()
+
+	db2, err := mydb.OpenDb(config.Db2)
+	if err != nil {
+		return
+	}
+	defer db2.Close()
+
+	normalized := func(err error) error {
+		if err != nil && config.Normalize {
+			return nil
+		}
+		return err
+	}
+
+	global1, _, offset1, err := db1.TimeZone(ctx)
+	if err != nil {
+		return
+	}
+	global2, _, offset2, err := db2.TimeZone(ctx)
+	if err != nil {
+		return
+	}
+	if offset1 != offset2 {
+		err = fmt.Errorf("Db1 %v (%v), Db2 %v (%v), set Normalize to read TIMESTAMP in UTC", global1, offset1, global2, offset2)
+	}
+	report.add("time zone", normalized(err))
+
+	for _, logicalName := range config.SyncTables {
+		tableConfig := config.Tables[logicalName]
+		table1, err := db1.Table(ctx, physicalTables(logicalName, tableConfig, "Db1")[0])
+		if err != nil {
+			continue
+		}
+		table2, err := db2.Table(ctx, physicalTables(logicalName, tableConfig, "Db2")[0])
+		if err != nil {
+			continue
+		}
+
+		differs := make([]string, 0)
+		for _, col := range table1.Columns {
+			info1, info2 := table1.Infos[col], table2.Infos[col]
+			if info1.Charset != info2.Charset || info1.Collation != info2.Collation {
+				differs = append(differs, fmt.Sprintf("%v %v/%v", col, info1.Collation, info2.Collation))
+			}
+		}
+		if len(differs) > 0 {
+			err = errors.New("collations differ, set Normalize to compare by them: " + strings.Join(differs, ", "))
+		}
+		report.add(logicalName+" charsets", normalized(err))
+	}
+}
+
+func readConfigStrict(fpath string) (Config, error) {
+	config := Config{}
+	meta, err := myconf.Load(fpath, "DBSYNC", &config)
+	if err != nil {
+		return config, err
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return config, errors.New("unknown keys " + strings.Join(keys, ", "))
+	}
+
+	return config, nil
+}
+
+func (report *CheckReport) checkDb(ctx context.Context, side, dataSourceName string, config Config) {
+	db, err := mydb.OpenDb(dataSourceName)
+	if !report.add(side+" open", err) {
+		return
+	}
+	defer db.Close()
+
+	if !report.add(side+" ping", db.PingContext(ctx)) {
+		return
+	}
+
+	database, err := db.CurrentDatabase(ctx)
+	if !report.add(side+" database", err) {
+		return
+	}
+
+	grants, err := db.Grants(ctx)
+	report.add(side+" show grants", err)
+
+	if config.Changelog {
+		exists, err := db.TableExists(ctx, ChangelogTable)
+		if err == nil && !exists {
+			err = errors.New("table does not exist, run changelog-setup first")
+		}
+		report.add(side+" "+ChangelogTable, err)
+	}
+
+	for _, logicalName := range config.SyncTables {
+		tableConfig := config.Tables[logicalName]
+		for _, tableName := range physicalTables(logicalName, tableConfig, side) {
+			name := side + " " + tableName
+			if !report.add(name+" table", checkTable(ctx, db, tableName, tableConfig)) {
+				continue
+			}
+
+			if grants != nil {
+				report.add(name+" privileges", checkPrivileges(grants, database, tableName))
+			}
+		}
+	}
+}
+
+// physicalTables lists the shard tables of the side, or the table itself.
+func physicalTables(tableName string, tableConfig TableConfig, side string) []string {
+	shard := tableConfig.Db1Shard
+	if side == "Db2" {
+		shard = tableConfig.Db2Shard
+	}
+	if shard == nil {
+		return []string{tableName}
+	}
+
+	names := make([]string, shard.Count)
+	for i := range names {
+		names[i] = shard.tableName(i)
+	}
+
+	return names
+}
+
+func checkTable(ctx context.Context, db *mydb.Db, tableName string, tableConfig TableConfig) error {
+	exists, err := db.TableExists(ctx, tableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("table does not exist")
+	}
+
+	table, err := db.Table(ctx, tableName)
+	if err != nil {
+		return err
+	}
+
+	pk, err := db.PrimaryKey(ctx, tableName)
+	if err != nil {
+		return err
+	}
+
+	// 同步时按主键分页和比较
+	if len(pk) != 1 {
+		return fmt.Errorf("a single column primary key is needed, found %v", pk)
+	}
+
+	if tableConfig.OnCollision == CollisionRemap {
+		autoIncrement, err := db.IsAutoIncrement(ctx, tableName, pk[0])
+		if err != nil {
+			return err
+		}
+		if !autoIncrement {
+			return errors.New("remap needs the auto increment key, " + pk[0] + " is not")
+		}
+	}
+
+	if err := table.CheckColumns(tableConfig.RemapIdentity...); err != nil {
+		return err
+	}
+
+	return table.CheckColumns(tableConfig.UpdateColumns...)
+}
+
+var grantRegexp = regexp.MustCompile("^GRANT (.+?) ON (.+?) TO ")
+var columnPrivilegeRegexp = regexp.MustCompile(`[A-Z ]+\([^)]*\)`)
+
+func checkPrivileges(grants []string, database, tableName string) error {
+	privileges := grantedPrivileges(grants, database, tableName)
+	if privileges["ALL"] {
+		return nil
+	}
+
+	missing := make([]string, 0)
+	for _, privilege := range requiredPrivileges {
+		if !privileges[privilege] {
+			missing = append(missing, privilege)
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New("missing privileges " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// grantedPrivileges collects the privileges on the table from SHOW GRANTS
+// lines like "GRANT SELECT, INSERT ON `dba`.* TO 'user'@'%'".
+func grantedPrivileges(grants []string, database, tableName string) map[string]bool {
+	privileges := make(map[string]bool)
+	for _, grant := range grants {
+		m := grantRegexp.FindStringSubmatch(grant)
+		if m == nil || !grantScopeMatches(m[2], database, tableName) {
+			continue
+		}
+
+		// 列级权限不足以同步整行
+		for _, privilege := range strings.Split(columnPrivilegeRegexp.ReplaceAllString(m[1], ""), ",") {
+			privilege = strings.TrimSpace(privilege)
+			if privilege == "ALL PRIVILEGES" {
+				privilege = "ALL"
+			}
+			if privilege != "" {
+				privileges[privilege] = true
+			}
+		}
+	}
+
+	return privileges
+}
+
+func grantScopeMatches(scope, database, tableName string) bool {
+	grantDb, grantTable := splitGrantScope(scope)
+	if grantDb != "*" && !likeMatch(grantDb, database) {
+		return false
+	}
+
+	return grantTable == "*" || grantTable == tableName
+}
+
+func splitGrantScope(scope string) (string, string) {
+	if strings.HasPrefix(scope, "`") {
+		end := strings.Index(scope[1:], "`") + 1
+		if end > 0 && end+1 < len(scope) {
+			return scope[1:end], strings.Trim(scope[end+2:], "`")
+		}
+	}
+
+	i := strings.Index(scope, ".")
+	if i < 0 {
+		return scope, "*"
+	}
+
+	return scope[:i], strings.Trim(scope[i+1:], "`")
+}
+
+// likeMatch matches the database name against a grant pattern like db\_%.
+func likeMatch(pattern, s string) bool {
+	expr := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; {
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		case ch == '%':
+			expr += ".*"
+		case ch == '_':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+
+	matched, _ := regexp.MatchString(expr+"$", s)
+	return matched
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package dbsync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLikeMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"dba", "dba", true},
+		{"dba", "dba2", false},
+		{"db%", "dba", true},
+		{"db%", "db", true},
+		{"db_", "dba", true},
+		{"db_", "db", false},
+		{`db\_%`, "db_users", true},
+		{`db\_%`, "dbxusers", false},
+		{"db.1", "dbx1", false},
+		{"db.1", "db.1", true},
+		{"%", "anything", true},
+	}
+	for _, test := range tests {
+		if got := likeMatch(test.pattern, test.s); got != test.want {
+			t.Errorf("likeMatch(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
+
+func TestSplitGrantScope(t *testing.T) {
+	tests := []struct {
+		scope         string
+		database, tbl string
+	}{
+		{"*.*", "*", "*"},
+		{"`dba`.*", "dba", "*"},
+		{"`dba`.`tr_f_user`", "dba", "tr_f_user"},
+		{"`my.db`.`t`", "my.db", "t"},
+		{"dba.tr_f_user", "dba", "tr_f_user"},
+	}
+	for _, test := range tests {
+		database, tbl := splitGrantScope(test.scope)
+		if database != test.database || tbl != test.tbl {
+			t.Errorf("splitGrantScope(%q) = %q, %q, want %q, %q", test.scope, database, tbl, test.database, test.tbl)
+		}
+	}
+}
+
+func TestGrantedPrivileges(t *testing.T) {
+	tests := []struct {
+		grants []string
+		want   map[string]bool
+	}{
+		{[]string{"GRANT USAGE ON *.* TO 'sync'@'%'"}, map[string]bool{"USAGE": true}},
+		{[]string{"GRANT SELECT, INSERT, UPDATE ON `dba`.* TO 'sync'@'%'"},
+			map[string]bool{"SELECT": true, "INSERT": true, "UPDATE": true}},
+		{[]string{"GRANT ALL PRIVILEGES ON `d_a`.* TO 'sync'@'%'"}, map[string]bool{"ALL": true}},
+		{[]string{"GRANT SELECT ON `dba`.`tr_f_user` TO 'sync'@'%'", "GRANT INSERT ON `dba`.`other` TO 'sync'@'%'"},
+			map[string]bool{"SELECT": true}},
+		{[]string{"GRANT SELECT, UPDATE (`mobile`) ON `dba`.`tr_f_user` TO 'sync'@'%'"}, map[string]bool{"SELECT": true}},
+		{[]string{"GRANT SELECT ON `other`.* TO 'sync'@'%'"}, map[string]bool{}},
+	}
+	for _, test := range tests {
+		if got := grantedPrivileges(test.grants, "dba", "tr_f_user"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("grantedPrivileges(%q) = %v, want %v", test.grants, got, test.want)
+		}
+	}
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	tests := []struct {
+		grants []string
+		ok     bool
+	}{
+		{[]string{"GRANT SELECT, INSERT, UPDATE ON `dba`.* TO 'sync'@'%'"}, true},
+		{[]string{"GRANT ALL PRIVILEGES ON *.* TO 'root'@'localhost' WITH GRANT OPTION"}, true},
+		{[]string{"GRANT SELECT ON `dba`.* TO 'sync'@'%'", "GRANT INSERT, UPDATE ON `dba`.`tr_f_user` TO 'sync'@'%'"}, true},
+		{[]string{"GRANT SELECT ON `dba`.* TO 'sync'@'%'"}, false},
+	}
+	for _, test := range tests {
+		if err := checkPrivileges(test.grants, "dba", "tr_f_user"); (err == nil) != test.ok {
+			t.Errorf("checkPrivileges(%q) = %v, want ok %v", test.grants, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package dbsync
+
+import (
+	"../myconf"
+	"../mydb"
+	"../mynodb"
+	"errors"
+	"github.com/robfig/cron"
+	"strings"
+)
+
+type Config struct {
+	Db1, Db2     string
+	SyncTables   []string
+	WriteMode    string // insert(默认)/upsert
+	OneWay       bool   // 只把Db1同步到Db2
+	StateDir     string // 持久化状态库目录, 保存Merkle树的叶子区间等
+	StateBackend string // 状态库类型: nodb(默认)/memory/bolt, 也用于运行中记录主键的临时库
+	PageSize     int    // 按主键分页读取时每页的行数, 默认1000
+	Snapshot     bool   // 两边分别在一致性快照中读取
+	UndoDir      string // 回滚日志目录, 默认dbsync-undo
+	Verify       bool   // 同步后重新计算两边的行数和校验和, 仍不一致时退出码非0
+	Normalize    bool   // 两边连接统一使用UTC时区和utf8mb4, 按排序规则比较文本, 跳过会丢失字符的写入
+	Tables       map[string]TableConfig
+	Notify       NotifyConfig // 运行结束、失败或不一致行过多时调用的webhook
+	HistoryFile  string       // 每次运行每个表的不一致统计追加到该文件, 用于history命令和趋势页面
+	Changelog    bool         // 只比较触发器记录在_dbsync_changelog中的主键, 需要先执行changelog-setup
+
+	// daemon模式
+	Cron          string // 默认的cron表达式, 例如"*/30 * * * *"
+	DaemonHistory int    // 保留最近的运行记录数, 默认100
+	HttpListen    string // 查看计划和运行记录的页面地址, 例如":8497"
+}
+
+type TableConfig struct {
+	// upsert时更新的列, 默认除主键外的所有列
+	UpdateColumns []string
+	// 大于0时先用Merkle树找出不一致的主键区间, 每个叶子包含的行数
+	MerkleLeafRows int
+	// daemon模式下的cron表达式, 默认使用全局的Cron
+	Cron string
+	// 自增主键在两边对应内容不同的行时: 默认作为diff, remap时RemapIdentity不同的两行认为是不相关的两行,
+	// 用新主键插入对方, 映射保存在状态库中, 需要配置StateDir
+	OnCollision string
+	// remap时标识一行的列(自然键或唯一列), 同一主键的两行这些列相同时仍是同一行, 作为diff
+	RemapIdentity []string
+	// remap时引用本表主键的子表外键列, 格式为"表.列", 比较和写入子表时按映射改写
+	RemapChildren []string
+	// 该表在Db1或Db2中拆分为多个分表
+	Db1Shard *ShardConfig
+	Db2Shard *ShardConfig
+}
+
+// ReadConfig loads and validates the config file.
+func ReadConfig(fpath string) (Config, error) {
+	config := Config{}
+	if _, err := myconf.Load(fpath, "DBSYNC", &config); err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+func (config Config) UndoPath() string {
+	if config.UndoDir == "" {
+		return "dbsync-undo"
+	}
+
+	return config.UndoDir
+}
+
+func (config Config) cronSpec(tableName string) string {
+	if spec := config.Tables[tableName].Cron; spec != "" {
+		return spec
+	}
+
+	return config.Cron
+}
+
+func (config Config) Validate() error {
+	problems := make([]string, 0)
+	if config.Db1 == "" || config.Db2 == "" {
+		problems = append(problems, "Db1 and Db2 are required")
+	}
+	if len(config.SyncTables) == 0 {
+		problems = append(problems, "SyncTables is empty")
+	}
+
+	seen := make(map[string]bool)
+	for _, tableName := range config.SyncTables {
+		if seen[tableName] {
+			problems = append(problems, "duplicate table "+tableName+" in SyncTables")
+		}
+		seen[tableName] = true
+	}
+
+	if config.PageSize < 0 {
+		problems = append(problems, "PageSize is negative")
+	}
+
+	switch config.StateBackend {
+	case "", mynodb.BackendNodb, mynodb.BackendMemory, mynodb.BackendBolt:
+	default:
+		problems = append(problems, "unknown StateBackend "+config.StateBackend)
+	}
+
+	switch WriteMode(config.WriteMode) {
+	case "", WriteInsert, WriteUpsert:
+	default:
+		problems = append(problems, "unknown WriteMode "+config.WriteMode)
+	}
+
+	for _, tableName := range config.SyncTables {
+		if spec := config.cronSpec(tableName); spec != "" {
+			if _, err := cron.ParseStandard(spec); err != nil {
+				problems = append(problems, "cron of "+tableName+": "+err.Error())
+			}
+		}
+	}
+
+	for tableName, tableConfig := range config.Tables {
+		if !seen[tableName] {
+			problems = append(problems, "table "+tableName+" is configured but not in SyncTables")
+		}
+		if tableConfig.MerkleLeafRows < 0 {
+			problems = append(problems, "MerkleLeafRows of "+tableName+" is negative")
+		}
+
+		switch tableConfig.OnCollision {
+		case "":
+		case CollisionRemap:
+			if config.StateDir == "" || config.StateBackend == mynodb.BackendMemory {
+				problems = append(problems, "OnCollision of "+tableName+" needs a persistent StateDir")
+			}
+			if len(tableConfig.RemapIdentity) == 0 {
+				problems = append(problems, "OnCollision of "+tableName+" needs RemapIdentity")
+			}
+		default:
+			problems = append(problems, "unknown OnCollision "+tableConfig.OnCollision+" of "+tableName)
+		}
+
+		for _, shard := range []*ShardConfig{tableConfig.Db1Shard, tableConfig.Db2Shard} {
+			if shard == nil {
+				continue
+			}
+			if err := shard.validate(); err != nil {
+				problems = append(problems, err.Error()+" of "+tableName)
+			}
+			if tableConfig.MerkleLeafRows > 0 || tableConfig.OnCollision != "" {
+				problems = append(problems, "sharded table "+tableName+" does not support MerkleLeafRows or OnCollision")
+			}
+		}
+
+		if config.Changelog && (tableConfig.MerkleLeafRows > 0 || tableConfig.OnCollision != "") {
+			problems = append(problems, "Changelog does not support MerkleLeafRows or OnCollision of "+tableName)
+		}
+
+		for _, child := range tableConfig.RemapChildren {
+			if parts := strings.SplitN(child, ".", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				problems = append(problems, "RemapChildren "+child+" of "+tableName+" is not table.column")
+			}
+		}
+	}
+	problems = append(problems, childOrderProblems(config.SyncTables, config.Tables)...)
+
+	for _, event := range config.Notify.Events {
+		if event != EventFinished && event != EventFailed && event != EventDivergence {
+			problems = append(problems, "unknown Notify event "+event)
+		}
+	}
+	if config.Notify.DiffThreshold < 0 || config.Notify.SampleKeys < 0 {
+		problems = append(problems, "Notify DiffThreshold and SampleKeys must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// childOrderProblems reports the RemapChildren listed before their parent in
+// tables, a child is compared by the key map which the parent saves.
+func childOrderProblems(tables []string, configs map[string]TableConfig) []string {
+	order := make(map[string]int) // 在tables中的序号, 从1开始
+	for i, tableName := range tables {
+		order[tableName] = i + 1
+	}
+
+	problems := make([]string, 0)
+	for tableName, tableConfig := range configs {
+		for _, child := range tableConfig.RemapChildren {
+			parts := strings.SplitN(child, ".", 2)
+			if len(parts) == 2 && order[parts[0]] > 0 && order[parts[0]] < order[tableName] {
+				problems = append(problems, "child "+parts[0]+" must be after "+tableName+" in SyncTables")
+			}
+		}
+	}
+
+	return problems
+}
+
+// Options makes the sync options, the State store and Undo journal are left
+// for the caller to open.
+func (config Config) Options(db1, db2 *mydb.Db) Options {
+	return Options{
+		Db1:          db1,
+		Db2:          db2,
+		Tables:       config.SyncTables,
+		WriteMode:    WriteMode(config.WriteMode),
+		OneWay:       config.OneWay,
+		TableConfigs: config.Tables,
+		PageSize:     config.PageSize,
+		Snapshot:     config.Snapshot,
+		StateBackend: config.StateBackend,
+		Verify:       config.Verify,
+		Normalize:    config.Normalize,
+		CountRows:    config.HistoryFile != "",
+		Changelog:    config.Changelog,
+	}
+}
+
+// DataSources returns Db1 and Db2, with the UTC session time zone and the
+// utf8mb4 charset when Normalize is set.
+func (config Config) DataSources() (string, string) {
+	if !config.Normalize {
+		return config.Db1, config.Db2
+	}
+
+	normalize := func(dsn string) string {
+		return mydb.SetDsnParam(mydb.SetDsnParam(dsn, "time_zone", "'+00:00'"), "charset", "utf8mb4")
+	}
+	return normalize(config.Db1), normalize(config.Db2)
+}
@@ -0,0 +1,28 @@
+package dbsync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChildOrderProblems(t *testing.T) {
+	configs := map[string]TableConfig{
+		"tr_f_user": {OnCollision: CollisionRemap, RemapChildren: []string{"tr_f_order.user_id", "tr_f_log.user_id"}},
+	}
+
+	tests := []struct {
+		tables []string
+		want   []string
+	}{
+		{[]string{"tr_f_user", "tr_f_order"}, []string{}},
+		{[]string{"tr_f_order", "tr_f_user"}, []string{"child tr_f_order must be after tr_f_user in SyncTables"}},
+		// 不在同一次运行中的表不检查
+		{[]string{"tr_f_order"}, []string{}},
+		{[]string{"tr_f_user"}, []string{}},
+	}
+	for _, test := range tests {
+		if got := childOrderProblems(test.tables, configs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("childOrderProblems(%q) = %q, want %q", test.tables, got, test.want)
+		}
+	}
+}
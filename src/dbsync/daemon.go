@@ -0,0 +1,303 @@
+package dbsync
+
+import (
+	"context"
+	"errors"
+	"github.com/robfig/cron"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultDaemonHistory = 100
+
+type RunRecord struct {
+	TableName string
+	RunId     string
+	Start     time.Time
+	Duration  time.Duration
+	Status    string // ok/failed/skipped
+	Result    TableResult
+	Err       string
+}
+
+type tableSchedule struct {
+	TableName string
+	Spec      string
+	schedule  cron.Schedule
+}
+
+// Daemon runs the tables by their cron schedules, a table is skipped when
+// its previous run is not finished yet.
+type Daemon struct {
+	options      Options
+	undoDir      string
+	notify       NotifyConfig
+	historyStore *HistoryStore // 没有配置HistoryFile时为nil
+	historySize  int
+	schedules    []tableSchedule
+	cron         *cron.Cron
+	ctx          context.Context
+	jobs         sync.WaitGroup // 正在运行的同步
+	stopped      chan struct{}  // 停止调度并且同步都结束后关闭
+
+	mutex    sync.Mutex
+	stopping bool // ctx取消后不再开始新的同步
+	running  map[string]bool
+	history  []RunRecord // 最近的在前
+}
+
+// NewDaemon schedules the tables of config, options are used as the base
+// options of every run.
+func NewDaemon(config Config, options Options) (*Daemon, error) {
+	daemon := &Daemon{
+		options:     options,
+		undoDir:     config.UndoPath(),
+		notify:      config.Notify,
+		historySize: config.DaemonHistory,
+		cron:        cron.New(),
+		stopped:     make(chan struct{}),
+		running:     make(map[string]bool),
+	}
+	if daemon.historySize <= 0 {
+		daemon.historySize = defaultDaemonHistory
+	}
+	if config.HistoryFile != "" {
+		daemon.historyStore = NewHistoryStore(config.HistoryFile)
+	}
+
+	for _, tableName := range config.SyncTables {
+		spec := config.cronSpec(tableName)
+		if spec == "" {
+			continue
+		}
+
+		schedule, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, errors.New("dbsync: cron of " + tableName + ": " + err.Error())
+		}
+
+		daemon.schedules = append(daemon.schedules, tableSchedule{tableName, spec, schedule})
+	}
+
+	if len(daemon.schedules) == 0 {
+		return nil, errors.New("dbsync: no table is scheduled, set Cron in the config")
+	}
+
+	return daemon, nil
+}
+
+// Start starts the schedules, the running syncs are canceled with ctx, and
+// Wait returns after they are finished.
+func (daemon *Daemon) Start(ctx context.Context) {
+	daemon.ctx = ctx
+	for _, s := range daemon.schedules {
+		tableName := s.TableName
+		daemon.cron.Schedule(s.schedule, cron.FuncJob(func() { daemon.runTable(tableName) }))
+	}
+
+	daemon.cron.Start()
+	go func() {
+		<-ctx.Done()
+		daemon.cron.Stop()
+
+		daemon.mutex.Lock()
+		daemon.stopping = true
+		daemon.mutex.Unlock()
+
+		daemon.jobs.Wait()
+		close(daemon.stopped)
+	}()
+}
+
+// Wait waits until ctx of Start is canceled and the running syncs are finished.
+func (daemon *Daemon) Wait() {
+	<-daemon.stopped
+}
+
+func (daemon *Daemon) runTable(tableName string) {
+	record := RunRecord{TableName: tableName, Start: time.Now(), Status: "ok"}
+	acquired, stopping := daemon.acquire(tableName)
+	if stopping {
+		return
+	}
+	defer daemon.jobs.Done()
+	if !acquired {
+		record.Status, record.Err = "skipped", "previous run is not finished"
+		daemon.addHistory(record)
+		return
+	}
+	defer daemon.release(tableName)
+
+	resultHandler := &resultHandler{}
+	options := daemon.options
+	options.Tables = []string{tableName}
+
+	var notifier *Notifier
+	err := func() error {
+		undo, err := OpenUndoJournal(daemon.undoDir)
+		if err != nil {
+			return err
+		}
+		defer undo.Close()
+		options.Undo, record.RunId = undo, undo.RunId
+
+		notifier = NewNotifier(daemon.notify, undo.RunId)
+		options.Handler = Handlers(&ConsoleHandler{}, resultHandler, notifier)
+		if daemon.historyStore != nil {
+			options.Handler = Handlers(options.Handler, daemon.historyStore.Recorder(undo.RunId, daemon.notify.SampleKeys))
+		}
+		syncer, err := NewSyncer(options)
+		if err != nil {
+			return err
+		}
+
+		return syncer.Run(daemon.ctx)
+	}()
+	if notifier == nil {
+		notifier = NewNotifier(daemon.notify, record.RunId)
+	}
+	notifier.Finish(err)
+
+	record.Duration = time.Now().Sub(record.Start)
+	record.Result = resultHandler.result
+	if err != nil {
+		record.Status, record.Err = "failed", err.Error()
+	}
+
+	daemon.addHistory(record)
+}
+
+// acquire marks the table as running, a job is counted in jobs unless the
+// daemon is stopping.
+func (daemon *Daemon) acquire(tableName string) (acquired, stopping bool) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	if daemon.stopping {
+		return false, true
+	}
+	daemon.jobs.Add(1)
+	if daemon.running[tableName] {
+		return false, false
+	}
+
+	daemon.running[tableName] = true
+	return true, false
+}
+
+func (daemon *Daemon) release(tableName string) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	delete(daemon.running, tableName)
+}
+
+func (daemon *Daemon) addHistory(record RunRecord) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	daemon.history = append([]RunRecord{record}, daemon.history...)
+	if len(daemon.history) > daemon.historySize {
+		daemon.history = daemon.history[:daemon.historySize]
+	}
+}
+
+// History returns the recent runs, the latest first.
+func (daemon *Daemon) History() []RunRecord {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	return append([]RunRecord(nil), daemon.history...)
+}
+
+type scheduleView struct {
+	TableName string
+	Spec      string
+	Next      time.Time
+	Running   bool
+}
+
+func (daemon *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/history" {
+		daemon.serveHistory(w)
+		return
+	}
+
+	now := time.Now()
+	schedules := make([]scheduleView, len(daemon.schedules))
+	daemon.mutex.Lock()
+	for i, s := range daemon.schedules {
+		schedules[i] = scheduleView{s.TableName, s.Spec, s.schedule.Next(now), daemon.running[s.TableName]}
+	}
+	daemon.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	daemonTempl.Execute(w, map[string]interface{}{
+		"Now":       now,
+		"Schedules": schedules,
+		"History":   daemon.History(),
+	})
+}
+
+func (daemon *Daemon) serveHistory(w http.ResponseWriter) {
+	if daemon.historyStore == nil {
+		http.Error(w, "HistoryFile is not configured", http.StatusNotFound)
+		return
+	}
+
+	records, err := daemon.historyStore.Read()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	WriteTrendsHTML(w, Trends(records))
+}
+
+type resultHandler struct {
+	NopHandler
+	result TableResult
+}
+
+func (h *resultHandler) OnTableDone(result TableResult) {
+	h.result = result
+}
+
+var daemonTempl = template.Must(template.New("").Parse(daemonHTML))
+
+const daemonHTML = `<!DOCTYPE html>
+<html>
+<head>
+<title>dbsync</title>
+<meta http-equiv="refresh" content="30">
+<style>
+table { border-collapse: collapse; font-size: 13px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.failed { color: #c00; }
+.skipped { color: #999; }
+</style>
+</head>
+<body>
+<h3>Schedules ({{.Now.Format "2006-01-02 15:04:05"}})</h3>
+<table>
+<tr><th>Table</th><th>Cron</th><th>Next run</th><th>Running</th></tr>
+{{range .Schedules}}
+<tr><td>{{.TableName}}</td><td>{{.Spec}}</td><td>{{.Next.Format "2006-01-02 15:04:05"}}</td><td>{{if .Running}}yes{{end}}</td></tr>
+{{end}}
+</table>
+<h3>Recent runs</h3>
+<p><a href="/history">Divergence history</a></p>
+<table>
+<tr><th>Start</th><th>Table</th><th>Run id</th><th>Status</th><th>To right</th><th>To left</th><th>Diffs</th><th>Updated</th><th>Errors</th><th>Duration</th><th>Error</th></tr>
+{{range .History}}
+<tr class="{{.Status}}"><td>{{.Start.Format "2006-01-02 15:04:05"}}</td><td>{{.TableName}}</td><td>{{.RunId}}</td><td>{{.Status}}</td>
+<td>{{.Result.LeftOnly}}</td><td>{{.Result.RightOnly}}</td><td>{{.Result.Diffs}}</td><td>{{.Result.Updated}}</td><td>{{.Result.Errors}}</td>
+<td>{{.Duration}}</td><td>{{.Err}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`
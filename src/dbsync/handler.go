@@ -0,0 +1,140 @@
+package dbsync
+
+import (
+	"../mydb"
+	"../myutil"
+	"fmt"
+	"time"
+)
+
+type TableResult struct {
+	TableName  string
+	LeftOnly   int // 只在Db1中存在, 已补充到Db2的行数
+	RightOnly  int // 只在Db2中存在, 已补充到Db1的行数
+	Diffs      int
+	Updated    int // upsert模式下按Db1更新的Db2差异行数
+	Deleted    int // Changelog模式下按另一边删除的行数
+	Errors     int
+	DiffRanges int           // Merkle树比较后不一致的主键区间数
+	Remaps     []KeyRemap    // 主键冲突后用新主键插入的行
+	Verify     *VerifyResult // 配置Verify时同步后的校验结果
+	Rows1      int64         // 配置CountRows时同步后两边的行数
+	Rows2      int64
+	Snapshot1  *mydb.BinlogPos // 快照模式下Db1快照的binlog位置
+	Snapshot2  *mydb.BinlogPos
+	Duration   time.Duration
+	Err        error
+}
+
+// Handler receives the events of a sync run. The row maps must not be kept
+// or modified after the callback returns.
+type Handler interface {
+	OnLeftOnly(tableName, pk string, row map[string]string)
+	OnRightOnly(tableName, pk string, row map[string]string)
+	OnDiff(tableName, pk string, columns []string, row1, row2 map[string]string)
+	OnError(tableName string, err error)
+	OnTableDone(result TableResult)
+}
+
+// NopHandler can be embedded to implement only some of the callbacks.
+type NopHandler struct{}
+
+func (NopHandler) OnLeftOnly(tableName, pk string, row map[string]string)  {}
+func (NopHandler) OnRightOnly(tableName, pk string, row map[string]string) {}
+func (NopHandler) OnDiff(tableName, pk string, columns []string, row1, row2 map[string]string) {
+}
+func (NopHandler) OnError(tableName string, err error) {}
+func (NopHandler) OnTableDone(result TableResult)      {}
+
+type multiHandler []Handler
+
+// Handlers combines the handlers, the events are sent to them in order.
+func Handlers(handlers ...Handler) Handler {
+	return multiHandler(handlers)
+}
+
+func (handlers multiHandler) OnLeftOnly(tableName, pk string, row map[string]string) {
+	for _, h := range handlers {
+		h.OnLeftOnly(tableName, pk, row)
+	}
+}
+
+func (handlers multiHandler) OnRightOnly(tableName, pk string, row map[string]string) {
+	for _, h := range handlers {
+		h.OnRightOnly(tableName, pk, row)
+	}
+}
+
+func (handlers multiHandler) OnDiff(tableName, pk string, columns []string, row1, row2 map[string]string) {
+	for _, h := range handlers {
+		h.OnDiff(tableName, pk, columns, row1, row2)
+	}
+}
+
+func (handlers multiHandler) OnError(tableName string, err error) {
+	for _, h := range handlers {
+		h.OnError(tableName, err)
+	}
+}
+
+func (handlers multiHandler) OnTableDone(result TableResult) {
+	for _, h := range handlers {
+		h.OnTableDone(result)
+	}
+}
+
+// ConsoleHandler prints the differences and table summaries to stdout.
+type ConsoleHandler struct {
+	NopHandler
+	diffRows int
+}
+
+func (h *ConsoleHandler) OnDiff(tableName, pk string, columns []string, row1, row2 map[string]string) {
+	h.diffRows += 1
+	fmt.Printf("%v<<<%v\n%v>>>%v\n",
+		h.diffRows, myutil.RowToString(columns, copyRow(row1)),
+		h.diffRows, myutil.RowToString(columns, copyRow(row2)))
+}
+
+func (h *ConsoleHandler) OnError(tableName string, err error) {
+	fmt.Println(tableName, err)
+}
+
+func (h *ConsoleHandler) OnTableDone(result TableResult) {
+	h.diffRows = 0
+	if result.Err != nil {
+		fmt.Printf("Failed to merge %v: %v\n", result.TableName, result.Err)
+	}
+
+	for _, remap := range result.Remaps {
+		fmt.Printf("Remapped %v key %v to %v in %v\n", result.TableName, remap.Pk, remap.NewPk, remap.Side)
+	}
+
+	if result.Snapshot1 != nil {
+		fmt.Printf("Snapshot of %v at Db1 %v, Db2 %v\n", result.TableName, result.Snapshot1, result.Snapshot2)
+	}
+
+	fmt.Printf("Merged %v with %v rows to right, %v rows to left, %v diff rows (%v updated) in %v\n",
+		result.TableName, result.LeftOnly, result.RightOnly, result.Diffs, result.Updated, result.Duration)
+	if result.Deleted > 0 {
+		fmt.Printf("Deleted %v rows of %v which are deleted on the other side\n", result.Deleted, result.TableName)
+	}
+
+	if v := result.Verify; v != nil {
+		if v.Diverged {
+			fmt.Printf("Verify %v failed: Db1 %v rows, Db2 %v rows, still %v rows only in Db1, %v rows only in Db2, %v diff rows\n",
+				result.TableName, v.Count1, v.Count2, v.LeftOnly, v.RightOnly, v.Diffs)
+		} else {
+			fmt.Printf("Verified %v: Db1 %v rows, Db2 %v rows\n", result.TableName, v.Count1, v.Count2)
+		}
+	}
+}
+
+func copyRow(row map[string]string) map[string]string {
+	m := make(map[string]string, len(row))
+	for k, v := range row {
+		m[k] = v
+	}
+
+	return m
+}
@@ -0,0 +1,245 @@
+package dbsync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+不一致历史(HistoryFile):
+1) 每次运行每个表结束时追加一行JSON到HistoryFile, 包括同步后两边的行数、只在一边存在和不一致的行数以及主键样本
+2) history命令按表列出每次运行的不一致行数和与上一次相比的变化, history-html生成趋势页面, daemon页面的/history相同
+3) 上一次没有不一致而这次有, 或者出现了上一次样本中没有的主键时标记为new. 样本最多Notify.SampleKeys个, 只能发现样本中的新主键
+*/
+
+type HistoryRecord struct {
+	RunId string    `json:"runId"`
+	Time  time.Time `json:"time"`
+	Rows1 int64     `json:"rows1"`
+	Rows2 int64     `json:"rows2"`
+	TableSummary
+}
+
+// HistoryStore appends the records to a JSON lines file.
+type HistoryStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewHistoryStore(path string) *HistoryStore {
+	return &HistoryStore{path: path}
+}
+
+func (store *HistoryStore) Append(record HistoryRecord) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if dir := filepath.Dir(store.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(store.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(file).Encode(record)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Read returns all the records in the appended order, no file is no record.
+func (store *HistoryStore) Read() ([]HistoryRecord, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	records := make([]HistoryRecord, 0)
+	file, err := os.Open(store.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Recorder records every table of the run into the store.
+func (store *HistoryStore) Recorder(runId string, sampleKeys int) Handler {
+	return &historyRecorder{summaryHandler: newSummaryHandler(sampleKeys), store: store, runId: runId}
+}
+
+type historyRecorder struct {
+	*summaryHandler
+	store *HistoryStore
+	runId string
+}
+
+func (recorder *historyRecorder) OnTableDone(result TableResult) {
+	record := HistoryRecord{
+		RunId:        recorder.runId,
+		Time:         time.Now(),
+		Rows1:        result.Rows1,
+		Rows2:        result.Rows2,
+		TableSummary: recorder.done(result),
+	}
+	if err := recorder.store.Append(record); err != nil {
+		fmt.Println("history", recorder.store.path, err)
+	}
+}
+
+type HistoryPoint struct {
+	HistoryRecord
+	Change  int      // 与上一次运行相比不一致行数的变化
+	New     bool     // 新出现的不一致
+	NewKeys []string // 上一次样本中没有的主键
+}
+
+type TableTrend struct {
+	Table  string
+	Points []HistoryPoint // 按时间顺序
+}
+
+// Trends groups the records by table, in the order the tables first appear.
+func Trends(records []HistoryRecord) []TableTrend {
+	trends := make([]TableTrend, 0)
+	index := make(map[string]int)
+	for _, record := range records {
+		i, ok := index[record.Table]
+		if !ok {
+			i = len(trends)
+			index[record.Table] = i
+			trends = append(trends, TableTrend{Table: record.Table})
+		}
+
+		point := HistoryPoint{HistoryRecord: record}
+		if n := len(trends[i].Points); n > 0 {
+			prev := trends[i].Points[n-1].HistoryRecord
+			point.Change = record.Divergence() - prev.Divergence()
+			point.NewKeys = newKeys(prev, record)
+			point.New = len(point.NewKeys) > 0 || (prev.Divergence() == 0 && record.Divergence() > 0)
+		}
+		trends[i].Points = append(trends[i].Points, point)
+	}
+
+	return trends
+}
+
+func newKeys(prev, record HistoryRecord) []string {
+	seen := make(map[string]bool)
+	for _, keys := range [][]string{prev.LeftKeys, prev.RightKeys, prev.DiffKeys} {
+		for _, key := range keys {
+			seen[key] = true
+		}
+	}
+
+	keys := make([]string, 0)
+	for _, sample := range [][]string{record.LeftKeys, record.RightKeys, record.DiffKeys} {
+		for _, key := range sample {
+			if !seen[key] {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
+
+// PrintTrends prints the runs of every table, the latest last.
+func PrintTrends(w io.Writer, trends []TableTrend) {
+	for _, trend := range trends {
+		fmt.Fprintln(w, trend.Table)
+		for _, point := range trend.Points {
+			fmt.Fprintf(w, "  %v %v rows %v/%v left %v right %v diffs %v (%+d)",
+				point.Time.Format("2006-01-02 15:04:05"), point.RunId, point.Rows1, point.Rows2,
+				point.LeftOnly, point.RightOnly, point.Diffs, point.Change)
+			if point.New {
+				fmt.Fprintf(w, " NEW %v", point.NewKeys)
+			}
+			if point.Error != "" {
+				fmt.Fprintf(w, " error: %v", point.Error)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// WriteTrendsHTML writes the trend page, the bars are scaled by the largest
+// divergence of the table.
+func WriteTrendsHTML(w io.Writer, trends []TableTrend) error {
+	return trendTempl.Execute(w, map[string]interface{}{
+		"Now":    time.Now(),
+		"Trends": trends,
+	})
+}
+
+var trendTempl = template.Must(template.New("").Funcs(template.FuncMap{
+	"barWidth": func(trend TableTrend, point HistoryPoint) int {
+		max := 0
+		for _, p := range trend.Points {
+			if p.Divergence() > max {
+				max = p.Divergence()
+			}
+		}
+		if max == 0 {
+			return 0
+		}
+		return point.Divergence() * 200 / max
+	},
+}).Parse(trendHTML))
+
+const trendHTML = `<!DOCTYPE html>
+<html>
+<head>
+<title>dbsync history</title>
+<style>
+table { border-collapse: collapse; font-size: 13px; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.bar { background: #e88; height: 10px; }
+.new { background: #fee; }
+.up { color: #c00; }
+.down { color: #080; }
+</style>
+</head>
+<body>
+<h3>Divergence history ({{.Now.Format "2006-01-02 15:04:05"}})</h3>
+{{range $trend := .Trends}}
+<h4>{{$trend.Table}}</h4>
+<table>
+<tr><th>Time</th><th>Run id</th><th>Db1 rows</th><th>Db2 rows</th><th>Left only</th><th>Right only</th><th>Diffs</th><th>Change</th><th></th><th>New keys</th><th>Error</th></tr>
+{{range $trend.Points}}
+<tr{{if .New}} class="new"{{end}}><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.RunId}}</td><td>{{.Rows1}}</td><td>{{.Rows2}}</td>
+<td>{{.LeftOnly}}</td><td>{{.RightOnly}}</td><td>{{.Diffs}}</td>
+<td class="{{if gt .Change 0}}up{{else if lt .Change 0}}down{{end}}">{{if gt .Change 0}}+{{end}}{{.Change}}</td>
+<td><div class="bar" style="width: {{barWidth $trend .}}px"></div></td>
+<td>{{if .New}}NEW {{range .NewKeys}}{{.}} {{end}}{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`
@@ -0,0 +1,368 @@
+package dbsync
+
+import (
+	"../mydb"
+	"../mynodb"
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+/*
+Merkle树比较:
+1) 叶子是按主键排序后每MerkleLeafRows行的主键区间, 区间边界在Db1上计算, 保存在状态库中, 两边共用.
+   每次运行时最后一个叶子超过MerkleLeafRows行的部分再分成新的叶子, 所以表增长后叶子不会无限变大
+2) 节点的哈希是区间内所有行哈希的BIT_XOR(同pt-table-checksum), 父节点的哈希即子节点哈希的异或, 由数据库端计算
+3) 从根节点开始逐层比较两边的哈希, 只展开不一致的节点, 最终得到不一致的叶子区间, 再逐行比较这些区间
+4) 每边算过的各层节点哈希保存在状态库中(merkle:<表>:Db1:<层>), 每次运行都重新计算两边根节点的哈希,
+   一边的根节点与保存的一致时该边没有变化, 直接使用保存的节点哈希, 只有变化的一边才逐层查询数据库.
+   所以重复比较没有变化的表只需要每边一次根节点查询; 叶子区间变化时保存的哈希作废
+*/
+
+const merkleFanout = 16
+
+type pkRange struct {
+	lo, hi       string
+	hasLo, hasHi bool
+}
+
+// where adds the conditions of the range on the primary key to the query.
+func (r pkRange) where(query *mydb.Query, pk mydb.ColumnInfo) *mydb.Query {
+	if r.hasLo {
+		query.Where(pk.Name, ">=", pk.Arg(r.lo))
+	}
+	if r.hasHi {
+		query.Where(pk.Name, "<", pk.Arg(r.hi))
+	}
+
+	return query
+}
+
+func (r pkRange) String() string {
+	lo, hi := "-inf", "+inf"
+	if r.hasLo {
+		lo = r.lo
+	}
+	if r.hasHi {
+		hi = r.hi
+	}
+
+	return "[" + lo + ", " + hi + ")"
+}
+
+type merkleNode struct {
+	Count int64
+	Hash  uint64
+}
+
+type merkleBounds struct {
+	LeafRows int
+	Bounds   []string // 第i个叶子的区间为[Bounds[i-1], Bounds[i])
+}
+
+// merkleHashes are the saved node hashes of a side, Levels[level][index] is
+// a computed node.
+type merkleHashes struct {
+	Bounds uint32               // 叶子区间的crc32, 区间变化时保存的哈希作废
+	Levels []map[int]merkleNode `json:"-"`
+}
+
+type merkleTree struct {
+	ctx       context.Context
+	db1, db2  querier
+	state     mynodb.StateStore
+	table     *mydb.Table
+	tableName string
+	pkCol     string
+	hashExpr  string
+	bounds    []string
+}
+
+func newMerkleTree(ctx context.Context, db1, db2 querier, state mynodb.StateStore,
+	table *mydb.Table, pkCol string, leafRows int) (*merkleTree, error) {
+	tree := &merkleTree{
+		ctx:       ctx,
+		db1:       db1,
+		db2:       db2,
+		state:     state,
+		table:     table,
+		tableName: table.Name,
+		pkCol:     pkCol,
+		hashExpr:  rowHashExpr(table),
+	}
+
+	var err error
+	tree.bounds, err = tree.loadBounds(leafRows)
+	return tree, err
+}
+
+// rowHashExpr hashes a row into an unsigned 64 bit integer, NULL and empty are
+// told apart by the isnull flags.
+func rowHashExpr(table *mydb.Table) string {
+	columns := make([]string, len(table.Columns))
+	nulls := make([]string, len(table.Columns))
+	for i, col := range table.Columns {
+		columns[i] = table.Quote(col)
+		nulls[i] = "isnull(" + columns[i] + ")"
+	}
+
+	return "cast(conv(substring(md5(concat_ws('#', " + strings.Join(columns, ", ") +
+		", concat(" + strings.Join(nulls, ", ") + "))), 1, 16), 16, 10) as unsigned)"
+}
+
+func (tree *merkleTree) stateKey(parts ...string) string {
+	return "merkle:" + tree.tableName + ":" + strings.Join(parts, ":")
+}
+
+// loadBounds reuses the leaf bounds in the state store, and computes them
+// on Db1 when missing or built with another leaf size. The rows after the
+// last bound are split into new leaves when there are more than leafRows.
+func (tree *merkleTree) loadBounds(leafRows int) ([]string, error) {
+	key := tree.stateKey("bounds")
+	bounds := make([]string, 0)
+	if value, _ := tree.state.Get(key); value != "" {
+		stored := merkleBounds{}
+		if err := json.Unmarshal([]byte(value), &stored); err == nil && stored.LeafRows == leafRows {
+			bounds = stored.Bounds
+		}
+	}
+
+	loaded := len(bounds)
+	for {
+		query := tree.table.Select(tree.pkCol)
+		if len(bounds) > 0 {
+			query.Where(tree.pkCol, ">=", tree.table.Infos[tree.pkCol].Arg(bounds[len(bounds)-1]))
+		}
+
+		bound, found, err := tree.queryBound(query.OrderBy(tree.pkCol).Limit(1).Offset(leafRows))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			break
+		}
+
+		bounds = append(bounds, bound)
+	}
+
+	if loaded > 0 && loaded == len(bounds) {
+		return bounds, nil
+	}
+
+	value, _ := json.Marshal(merkleBounds{leafRows, bounds})
+	return bounds, tree.state.Set(key, string(value))
+}
+
+func (tree *merkleTree) queryBound(query *mydb.Query) (string, bool, error) {
+	sql, args, err := query.Sql()
+	if err != nil {
+		return "", false, err
+	}
+
+	rows, err := tree.db1.QueryContext(tree.ctx, sql, args...)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+
+	bound := ""
+	if !rows.Next() {
+		return bound, false, rows.Err()
+	}
+
+	return bound, true, rows.Scan(&bound)
+}
+
+func (tree *merkleTree) leafCount() int {
+	return len(tree.bounds) + 1
+}
+
+// width is the node count of the level, level 0 are the leaves.
+func (tree *merkleTree) width(level int) int {
+	span := leafSpan(level)
+	return (tree.leafCount() + span - 1) / span
+}
+
+// leafSpan is the count of leaves under a node of the level.
+func leafSpan(level int) int {
+	span := 1
+	for i := 0; i < level; i++ {
+		span *= merkleFanout
+	}
+
+	return span
+}
+
+func (tree *merkleTree) topLevel() int {
+	level := 0
+	for tree.width(level) > 1 {
+		level++
+	}
+
+	return level
+}
+
+func (tree *merkleTree) nodeRange(level, index int) pkRange {
+	span := leafSpan(level)
+	first, last := index*span, (index+1)*span
+	if last > tree.leafCount() {
+		last = tree.leafCount()
+	}
+
+	r := pkRange{}
+	if first > 0 {
+		r.lo, r.hasLo = tree.bounds[first-1], true
+	}
+	if last-1 < len(tree.bounds) {
+		r.hi, r.hasHi = tree.bounds[last-1], true
+	}
+
+	return r
+}
+
+func (tree *merkleTree) nodeHash(db querier, r pkRange) (merkleNode, error) {
+	query := tree.table.Select().Expr("count(*)").Expr("coalesce(bit_xor(" + tree.hashExpr + "), 0)")
+	sql, args, err := r.where(query, tree.table.Infos[tree.pkCol]).Sql()
+	if err != nil {
+		return merkleNode{}, err
+	}
+
+	rows, err := db.QueryContext(tree.ctx, sql, args...)
+	if err != nil {
+		return merkleNode{}, err
+	}
+	defer rows.Close()
+
+	node := merkleNode{}
+	if rows.Next() {
+		err = rows.Scan(&node.Count, &node.Hash)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return node, err
+}
+
+// loadHashes returns the saved node hashes of the side when its current
+// root is the saved one, so the side is not changed, or only the root.
+func (tree *merkleTree) loadHashes(side string, root merkleNode) merkleHashes {
+	top := tree.topLevel()
+	bounds := crc32.ChecksumIEEE([]byte(strings.Join(tree.bounds, "\x00")))
+	hashes := merkleHashes{Bounds: bounds, Levels: make([]map[int]merkleNode, top+1)}
+	for level := range hashes.Levels {
+		hashes.Levels[level] = make(map[int]merkleNode)
+	}
+
+	stored := merkleHashes{}
+	value, _ := tree.state.Get(tree.stateKey(side))
+	if value == "" || json.Unmarshal([]byte(value), &stored) != nil || stored.Bounds != bounds {
+		hashes.Levels[top][0] = root
+		return hashes
+	}
+
+	for level := range hashes.Levels {
+		value, _ := tree.state.Get(tree.stateKey(side, strconv.Itoa(level)))
+		if value != "" && json.Unmarshal([]byte(value), &hashes.Levels[level]) != nil {
+			hashes.Levels[level] = make(map[int]merkleNode)
+		}
+	}
+	if saved, ok := hashes.Levels[top][0]; !ok || saved != root {
+		for level := range hashes.Levels {
+			hashes.Levels[level] = make(map[int]merkleNode)
+		}
+		hashes.Levels[top][0] = root
+	}
+
+	return hashes
+}
+
+// saveHashes saves the node hashes of the side for the next run.
+func (tree *merkleTree) saveHashes(side string, hashes merkleHashes) error {
+	pairs := make(map[string]string)
+	value, _ := json.Marshal(hashes)
+	pairs[tree.stateKey(side)] = string(value)
+	for level, nodes := range hashes.Levels {
+		value, _ := json.Marshal(nodes)
+		pairs[tree.stateKey(side, strconv.Itoa(level))] = string(value)
+	}
+
+	return tree.state.SetBatch(pairs)
+}
+
+// cachedHash returns the saved hash of the node, or computes and keeps it.
+func (tree *merkleTree) cachedHash(db querier, hashes merkleHashes, level, index int) (merkleNode, error) {
+	if node, ok := hashes.Levels[level][index]; ok {
+		return node, nil
+	}
+
+	node, err := tree.nodeHash(db, tree.nodeRange(level, index))
+	if err == nil {
+		hashes.Levels[level][index] = node
+	}
+	return node, err
+}
+
+// diff compares the trees level by level from the root, and returns the
+// leaf ranges which differ.
+func (tree *merkleTree) diff() ([]pkRange, error) {
+	root := tree.nodeRange(tree.topLevel(), 0)
+	root1, err := tree.nodeHash(tree.db1, root)
+	if err != nil {
+		return nil, err
+	}
+	root2, err := tree.nodeHash(tree.db2, root)
+	if err != nil {
+		return nil, err
+	}
+	hashes1, hashes2 := tree.loadHashes("Db1", root1), tree.loadHashes("Db2", root2)
+
+	ranges := make([]pkRange, 0)
+	level, nodes := tree.topLevel(), []int{0}
+	for ; len(nodes) > 0; level-- {
+		children := make([]int, 0)
+		for _, index := range nodes {
+			r := tree.nodeRange(level, index)
+			node1, err := tree.cachedHash(tree.db1, hashes1, level, index)
+			if err != nil {
+				return nil, err
+			}
+			node2, err := tree.cachedHash(tree.db2, hashes2, level, index)
+			if err != nil {
+				return nil, err
+			}
+
+			if node1 == node2 {
+				continue
+			}
+
+			if level == 0 {
+				ranges = appendRange(ranges, r)
+				continue
+			}
+
+			for child := index * merkleFanout; child < (index+1)*merkleFanout && child < tree.width(level-1); child++ {
+				children = append(children, child)
+			}
+		}
+
+		nodes = children
+	}
+
+	if err := tree.saveHashes("Db1", hashes1); err != nil {
+		return nil, err
+	}
+	return ranges, tree.saveHashes("Db2", hashes2)
+}
+
+// appendRange merges the adjacent leaf ranges, so that fewer queries are needed.
+func appendRange(ranges []pkRange, r pkRange) []pkRange {
+	if n := len(ranges); n > 0 && ranges[n-1].hasHi && r.hasLo && ranges[n-1].hi == r.lo {
+		ranges[n-1].hi, ranges[n-1].hasHi = r.hi, r.hasHi
+		return ranges
+	}
+
+	return append(ranges, r)
+}
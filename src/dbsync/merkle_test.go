@@ -0,0 +1,122 @@
+package dbsync
+
+import (
+	"../mynodb"
+	"testing"
+)
+
+func TestNodeRange(t *testing.T) {
+	bounds := make([]string, 0)
+	for i := 1; i < 20; i++ {
+		bounds = append(bounds, string(rune('a'+i)))
+	}
+	tree := &merkleTree{bounds: bounds}
+
+	if n := tree.leafCount(); n != 20 {
+		t.Fatalf("leafCount = %v, want 20", n)
+	}
+	if top := tree.topLevel(); top != 2 {
+		t.Fatalf("topLevel = %v, want 2", top)
+	}
+
+	tests := []struct {
+		level, index int
+		want         string
+	}{
+		{0, 0, "[-inf, b)"},
+		{0, 1, "[b, c)"},
+		{0, 19, "[t, +inf)"},
+		{1, 0, "[-inf, q)"},
+		{1, 1, "[q, +inf)"},
+		{2, 0, "[-inf, +inf)"},
+	}
+	for _, test := range tests {
+		if got := tree.nodeRange(test.level, test.index).String(); got != test.want {
+			t.Errorf("nodeRange(%v, %v) = %v, want %v", test.level, test.index, got, test.want)
+		}
+	}
+}
+
+func TestNodeRangeOneLeaf(t *testing.T) {
+	tree := &merkleTree{}
+	if top := tree.topLevel(); top != 0 {
+		t.Fatalf("topLevel = %v, want 0", top)
+	}
+	if got := tree.nodeRange(0, 0).String(); got != "[-inf, +inf)" {
+		t.Errorf("nodeRange(0, 0) = %v", got)
+	}
+}
+
+func TestAppendRange(t *testing.T) {
+	between := func(lo, hi string) pkRange {
+		return pkRange{lo: lo, hi: hi, hasLo: lo != "", hasHi: hi != ""}
+	}
+
+	tests := []struct {
+		name   string
+		ranges []pkRange
+		want   []string
+	}{
+		{"adjacent", []pkRange{between("", "b"), between("b", "c"), between("c", "")}, []string{"[-inf, +inf)"}},
+		{"gap", []pkRange{between("a", "b"), between("c", "d")}, []string{"[a, b)", "[c, d)"}},
+		{"partly adjacent", []pkRange{between("a", "b"), between("b", "c"), between("d", "e")}, []string{"[a, c)", "[d, e)"}},
+	}
+	for _, test := range tests {
+		merged := make([]pkRange, 0)
+		for _, r := range test.ranges {
+			merged = appendRange(merged, r)
+		}
+
+		got := make([]string, len(merged))
+		for i, r := range merged {
+			got[i] = r.String()
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMerkleHashes(t *testing.T) {
+	bounds := make([]string, 0)
+	for i := 1; i < 20; i++ {
+		bounds = append(bounds, string(rune('a'+i)))
+	}
+	tree := &merkleTree{tableName: "t", state: mynodb.NewMemStore(), bounds: bounds}
+	root := merkleNode{Count: 100, Hash: 7}
+
+	hashes := tree.loadHashes("Db2", root)
+	if len(hashes.Levels) != 3 || hashes.Levels[2][0] != root || len(hashes.Levels[0]) != 0 {
+		t.Fatalf("first loadHashes = %+v", hashes)
+	}
+	hashes.Levels[1][1] = merkleNode{Count: 40, Hash: 3}
+	hashes.Levels[0][17] = merkleNode{Count: 10, Hash: 5}
+	if err := tree.saveHashes("Db2", hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	// 根节点不变时使用保存的节点
+	if got := tree.loadHashes("Db2", root); got.Levels[1][1].Count != 40 || got.Levels[0][17].Hash != 5 {
+		t.Errorf("loadHashes of the same root = %+v", got)
+	}
+	if got := tree.loadHashes("Db1", root); len(got.Levels[1]) != 0 {
+		t.Errorf("loadHashes of the other side = %+v", got)
+	}
+
+	changed := merkleNode{Count: 101, Hash: 7}
+	if got := tree.loadHashes("Db2", changed); len(got.Levels[1]) != 0 || got.Levels[2][0] != changed {
+		t.Errorf("loadHashes of a changed root = %+v", got)
+	}
+
+	tree.bounds = append(tree.bounds, "z")
+	if got := tree.loadHashes("Db2", root); len(got.Levels[1]) != 0 {
+		t.Errorf("loadHashes of new bounds = %+v", got)
+	}
+}
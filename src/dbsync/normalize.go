@@ -0,0 +1,111 @@
+package dbsync
+
+import (
+	"../mydb"
+	"errors"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+时区、字符集和排序规则(Normalize = true):
+1) 两边的连接都设置time_zone='+00:00'和utf8mb4字符集, TIMESTAMP按UTC读取和写入, 文本统一按utf8mb4读取
+2) 比较文本列时按两边列的排序规则: 都是_ci时忽略大小写, 非NO PAD(_0900_)排序规则忽略末尾空格.
+   只近似排序规则, 不忽略重音(MySQL中utf8mb4_general_ci、_0900_ai_ci等认为e和é相等), 只差重音的值报告为diff并按另一边写入
+3) 写入前检查目标列的字符集能否表示该值(latin1/ascii/utf8mb3), 不能表示时报错跳过, 不写入乱码
+*/
+
+// rowsEqual compares the rows by the collations of the columns when Normalize is set.
+func (syncParam *tableSync) rowsEqual(row1, row2 map[string]string) bool {
+	if !syncParam.options.Normalize {
+		return reflect.DeepEqual(row1, row2)
+	}
+	if len(row1) != len(row2) {
+		return false
+	}
+
+	infos1, infos2 := syncParam.tables1.tables[0].Infos, syncParam.tables2.tables[0].Infos
+	for col, v1 := range row1 {
+		v2, ok := row2[col]
+		if !ok || !valuesEqual(infos1[col], infos2[col], v1, v2) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func valuesEqual(info1, info2 mydb.ColumnInfo, v1, v2 string) bool {
+	if v1 == v2 {
+		return true
+	}
+	if v1 == "NULL" || v2 == "NULL" || info1.Collation == "" || info2.Collation == "" {
+		return false
+	}
+
+	if !strings.Contains(info1.Collation, "_0900_") && !strings.Contains(info2.Collation, "_0900_") {
+		v1, v2 = strings.TrimRight(v1, " "), strings.TrimRight(v2, " ")
+	}
+	// 只忽略大小写, _ci排序规则大多还忽略重音, 这里仍作为不同
+	if strings.HasSuffix(info1.Collation, "_ci") && strings.HasSuffix(info2.Collation, "_ci") {
+		return strings.EqualFold(v1, v2)
+	}
+
+	return v1 == v2
+}
+
+// checkLossy returns an error when a value can not be kept by the charset
+// of its column in the table.
+func (syncParam *tableSync) checkLossy(table *mydb.Table, row map[string]string) error {
+	if !syncParam.options.Normalize {
+		return nil
+	}
+
+	lossy := make([]string, 0)
+	for col, value := range row {
+		info := table.Infos[col]
+		if value != "NULL" && !representable(info.Charset, value) {
+			lossy = append(lossy, col+"("+info.Charset+")")
+		}
+	}
+
+	if len(lossy) > 0 {
+		return errors.New("skipped the lossy conversion of " + strings.Join(lossy, ", ") + " in " + table.Name)
+	}
+
+	return nil
+}
+
+// cp1252Runes are the runes of 0x80-0x9f in the MySQL latin1, which is cp1252.
+var cp1252Runes = "€‚ƒ„…†‡ˆ‰Š‹ŒŽ‘’“”•–—˜™š›œžŸ\u0081\u008d\u008f\u0090\u009d"
+
+// representable checks the charsets which commonly lose data, the others
+// are taken as representable.
+func representable(charset, value string) bool {
+	if charset == "" || charset == "binary" {
+		return true
+	}
+	if !utf8.ValidString(value) {
+		return false
+	}
+
+	for _, r := range value {
+		switch charset {
+		case "ascii":
+			if r >= 0x80 {
+				return false
+			}
+		case "latin1":
+			if r >= 0x80 && (r < 0xa0 || r > 0xff) && !strings.ContainsRune(cp1252Runes, r) {
+				return false
+			}
+		case "utf8", "utf8mb3":
+			if r > 0xffff {
+				return false
+			}
+		}
+	}
+
+	return true
+}
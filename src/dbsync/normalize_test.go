@@ -0,0 +1,65 @@
+package dbsync
+
+import (
+	"../mydb"
+	"testing"
+)
+
+func TestValuesEqual(t *testing.T) {
+	ci := mydb.ColumnInfo{DataType: "varchar", Charset: "utf8mb4", Collation: "utf8mb4_general_ci"}
+	ci0900 := mydb.ColumnInfo{DataType: "varchar", Charset: "utf8mb4", Collation: "utf8mb4_0900_ai_ci"}
+	bin := mydb.ColumnInfo{DataType: "varchar", Charset: "utf8mb4", Collation: "utf8mb4_bin"}
+	number := mydb.ColumnInfo{DataType: "int"}
+
+	tests := []struct {
+		info1, info2 mydb.ColumnInfo
+		v1, v2       string
+		want         bool
+	}{
+		{ci, ci, "abc", "abc", true},
+		{ci, ci, "abc", "ABC", true},
+		{ci, ci, "abc ", "abc", true},
+		{ci, ci, "NULL", "null", false},
+		{ci, ci, "NULL", "NULL", true},
+		// 只忽略大小写, 不忽略重音
+		{ci, ci, "café", "cafe", false},
+		{ci, ci, "CAFÉ", "café", true},
+		{ci0900, ci0900, "abc ", "abc", false},
+		{ci0900, ci0900, "abc", "ABC", true},
+		{ci, ci0900, "abc ", "ABC", false},
+		{ci, bin, "abc", "ABC", false},
+		{bin, bin, "abc ", "abc", true},
+		{number, number, "1", "01", false},
+		{number, number, "1", "1", true},
+	}
+	for _, test := range tests {
+		if got := valuesEqual(test.info1, test.info2, test.v1, test.v2); got != test.want {
+			t.Errorf("valuesEqual(%v, %v, %q, %q) = %v, want %v", test.info1.Collation, test.info2.Collation,
+				test.v1, test.v2, got, test.want)
+		}
+	}
+}
+
+func TestRepresentable(t *testing.T) {
+	tests := []struct {
+		charset, value string
+		want           bool
+	}{
+		{"", "任意", true},
+		{"binary", "\xff", true},
+		{"ascii", "abc", true},
+		{"ascii", "é", false},
+		{"latin1", "café", true},
+		{"latin1", "€", true},
+		{"latin1", "中", false},
+		{"utf8mb3", "中", true},
+		{"utf8", "😀", false},
+		{"utf8mb4", "😀", true},
+		{"utf8mb4", "\xff", false},
+	}
+	for _, test := range tests {
+		if got := representable(test.charset, test.value); got != test.want {
+			t.Errorf("representable(%v, %q) = %v, want %v", test.charset, test.value, got, test.want)
+		}
+	}
+}
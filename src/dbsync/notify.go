@@ -0,0 +1,215 @@
+package dbsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventFinished   = "finished"
+	EventFailed     = "failed"
+	EventDivergence = "divergence" // 表的不一致行数超过DiffThreshold
+
+	defaultSampleKeys = 10
+)
+
+type NotifyConfig struct {
+	Webhooks      []string
+	Events        []string // 默认全部
+	DiffThreshold int      // 表的LeftOnly+RightOnly+Diffs超过该值时发送divergence
+	SampleKeys    int      // 每类不一致行最多带上的主键数, 默认10
+}
+
+type TableSummary struct {
+	Table     string   `json:"table"`
+	LeftOnly  int      `json:"leftOnly"`
+	RightOnly int      `json:"rightOnly"`
+	Diffs     int      `json:"diffs"`
+	Updated   int      `json:"updated"`
+	Deleted   int      `json:"deleted"`
+	Remapped  int      `json:"remapped"`
+	Diverged  bool     `json:"diverged"` // 同步后校验仍不一致
+	Errors    int      `json:"errors"`
+	Error     string   `json:"error,omitempty"`
+	LeftKeys  []string `json:"leftOnlyKeys"`
+	RightKeys []string `json:"rightOnlyKeys"`
+	DiffKeys  []string `json:"diffKeys"`
+}
+
+func (summary TableSummary) Divergence() int {
+	return summary.LeftOnly + summary.RightOnly + summary.Diffs
+}
+
+type NotifyPayload struct {
+	Event  string         `json:"event"`
+	RunId  string         `json:"runId"`
+	Time   time.Time      `json:"time"`
+	Error  string         `json:"error,omitempty"`
+	Tables []TableSummary `json:"tables"`
+}
+
+// summaryHandler collects the counts and a sample of keys of every table.
+type summaryHandler struct {
+	sampleKeys int
+	mutex      sync.Mutex
+	tables     []*TableSummary
+	current    map[string]*TableSummary
+}
+
+func newSummaryHandler(sampleKeys int) *summaryHandler {
+	if sampleKeys <= 0 {
+		sampleKeys = defaultSampleKeys
+	}
+
+	return &summaryHandler{sampleKeys: sampleKeys, current: make(map[string]*TableSummary)}
+}
+
+func (h *summaryHandler) table(tableName string) *TableSummary {
+	summary, ok := h.current[tableName]
+	if !ok {
+		summary = &TableSummary{Table: tableName, LeftKeys: []string{}, RightKeys: []string{}, DiffKeys: []string{}}
+		h.current[tableName] = summary
+		h.tables = append(h.tables, summary)
+	}
+
+	return summary
+}
+
+func (h *summaryHandler) sample(keys []string, pk string) []string {
+	if len(keys) < h.sampleKeys {
+		keys = append(keys, pk)
+	}
+
+	return keys
+}
+
+func (h *summaryHandler) OnLeftOnly(tableName, pk string, row map[string]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	summary := h.table(tableName)
+	summary.LeftKeys = h.sample(summary.LeftKeys, pk)
+}
+
+func (h *summaryHandler) OnRightOnly(tableName, pk string, row map[string]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	summary := h.table(tableName)
+	summary.RightKeys = h.sample(summary.RightKeys, pk)
+}
+
+func (h *summaryHandler) OnDiff(tableName, pk string, columns []string, row1, row2 map[string]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	summary := h.table(tableName)
+	summary.DiffKeys = h.sample(summary.DiffKeys, pk)
+}
+
+func (h *summaryHandler) OnError(tableName string, err error) {}
+
+func (h *summaryHandler) OnTableDone(result TableResult) {
+	h.done(result)
+}
+
+func (h *summaryHandler) done(result TableResult) TableSummary {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	summary := h.table(result.TableName)
+	summary.LeftOnly, summary.RightOnly, summary.Diffs = result.LeftOnly, result.RightOnly, result.Diffs
+	summary.Updated, summary.Errors, summary.Remapped = result.Updated, result.Errors, len(result.Remaps)
+	summary.Deleted = result.Deleted
+	if result.Err != nil {
+		summary.Error = result.Err.Error()
+	}
+	summary.Diverged = result.Verify != nil && result.Verify.Diverged
+
+	// 同一个表再次运行时重新统计
+	delete(h.current, result.TableName)
+	return *summary
+}
+
+func (h *summaryHandler) Summaries() []TableSummary {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	summaries := make([]TableSummary, len(h.tables))
+	for i, summary := range h.tables {
+		summaries[i] = *summary
+	}
+
+	return summaries
+}
+
+// Notifier posts the JSON NotifyPayload to the webhooks.
+type Notifier struct {
+	*summaryHandler
+	config NotifyConfig
+	runId  string
+	client *http.Client
+}
+
+func NewNotifier(config NotifyConfig, runId string) *Notifier {
+	return &Notifier{
+		summaryHandler: newSummaryHandler(config.SampleKeys),
+		config:         config,
+		runId:          runId,
+		client:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (notifier *Notifier) OnTableDone(result TableResult) {
+	summary := notifier.done(result)
+	if notifier.config.DiffThreshold > 0 && summary.Divergence() > notifier.config.DiffThreshold {
+		notifier.send(EventDivergence, nil, []TableSummary{summary})
+	}
+}
+
+// Finish sends the finished or failed event with all the tables of the run.
+func (notifier *Notifier) Finish(runErr error) {
+	event := EventFinished
+	if runErr != nil {
+		event = EventFailed
+	}
+
+	notifier.send(event, runErr, notifier.Summaries())
+}
+
+func (notifier *Notifier) send(event string, runErr error, tables []TableSummary) {
+	if !notifier.enabled(event) {
+		return
+	}
+
+	payload := NotifyPayload{Event: event, RunId: notifier.runId, Time: time.Now(), Tables: tables}
+	if runErr != nil {
+		payload.Error = runErr.Error()
+	}
+
+	body, _ := json.Marshal(payload)
+	for _, url := range notifier.config.Webhooks {
+		resp, err := notifier.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Println("notify", url, err)
+			continue
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Println("notify", url, resp.Status)
+		}
+	}
+}
+
+func (notifier *Notifier) enabled(event string) bool {
+	if len(notifier.config.Webhooks) == 0 {
+		return false
+	}
+
+	return len(notifier.config.Events) == 0 || containsString(notifier.config.Events, event)
+}
@@ -0,0 +1,127 @@
+package dbsync
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// webhook records the payloads posted to it.
+type webhook struct {
+	mutex    sync.Mutex
+	payloads []NotifyPayload
+}
+
+func (hook *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload := NotifyPayload{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	hook.payloads = append(hook.payloads, payload)
+}
+
+func (hook *webhook) events() []string {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+
+	events := make([]string, 0)
+	for _, payload := range hook.payloads {
+		events = append(events, payload.Event)
+	}
+	return events
+}
+
+// runNotifier reports two tables: t1 with 4 differing rows and t2 with 1.
+func runNotifier(config NotifyConfig, runErr error) *webhook {
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	config.Webhooks = []string{server.URL}
+	notifier := NewNotifier(config, "run-1")
+	notifier.OnLeftOnly("t1", "1", nil)
+	notifier.OnLeftOnly("t1", "2", nil)
+	notifier.OnLeftOnly("t1", "3", nil)
+	notifier.OnDiff("t1", "4", []string{"v"}, nil, nil)
+	notifier.OnTableDone(TableResult{TableName: "t1", LeftOnly: 3, Diffs: 1, Updated: 1,
+		Verify: &VerifyResult{Diverged: true}})
+	notifier.OnRightOnly("t2", "9", nil)
+	notifier.OnTableDone(TableResult{TableName: "t2", RightOnly: 1, Errors: 1, Err: errors.New("timeout")})
+	notifier.Finish(runErr)
+
+	return hook
+}
+
+func TestNotifierPayload(t *testing.T) {
+	hook := runNotifier(NotifyConfig{SampleKeys: 2}, nil)
+	if len(hook.payloads) != 1 {
+		t.Fatalf("payloads = %+v, want one", hook.payloads)
+	}
+
+	payload := hook.payloads[0]
+	if payload.Event != EventFinished || payload.RunId != "run-1" || payload.Error != "" || payload.Time.IsZero() {
+		t.Errorf("payload = %+v", payload)
+	}
+	want := []TableSummary{
+		{Table: "t1", LeftOnly: 3, Diffs: 1, Updated: 1, Diverged: true, LeftKeys: []string{"1", "2"},
+			RightKeys: []string{}, DiffKeys: []string{"4"}},
+		{Table: "t2", RightOnly: 1, Errors: 1, Error: "timeout", LeftKeys: []string{}, RightKeys: []string{"9"},
+			DiffKeys: []string{}},
+	}
+	if !reflect.DeepEqual(payload.Tables, want) {
+		t.Errorf("tables = %+v, want %+v", payload.Tables, want)
+	}
+}
+
+func TestNotifierEvents(t *testing.T) {
+	tests := []struct {
+		config NotifyConfig
+		runErr error
+		want   []string
+	}{
+		{NotifyConfig{}, nil, []string{EventFinished}},
+		{NotifyConfig{}, errors.New("canceled"), []string{EventFailed}},
+		// 只有t1的不一致行数超过2
+		{NotifyConfig{DiffThreshold: 2}, nil, []string{EventDivergence, EventFinished}},
+		{NotifyConfig{DiffThreshold: 4}, nil, []string{EventFinished}},
+		{NotifyConfig{DiffThreshold: 2, Events: []string{EventDivergence}}, errors.New("canceled"),
+			[]string{EventDivergence}},
+		{NotifyConfig{DiffThreshold: 2, Events: []string{EventFailed}}, nil, []string{}},
+		{NotifyConfig{Events: []string{EventFailed}}, errors.New("canceled"), []string{EventFailed}},
+	}
+	for _, test := range tests {
+		if got := runNotifier(test.config, test.runErr).events(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("events of %+v, %v = %v, want %v", test.config, test.runErr, got, test.want)
+		}
+	}
+}
+
+func TestNotifierDivergencePayload(t *testing.T) {
+	hook := runNotifier(NotifyConfig{DiffThreshold: 0, Events: []string{EventDivergence}}, nil)
+	if len(hook.payloads) != 0 {
+		t.Errorf("payloads without DiffThreshold = %+v", hook.payloads)
+	}
+
+	// t2只有1行不一致, 不发送
+	hook = runNotifier(NotifyConfig{DiffThreshold: 1, Events: []string{EventDivergence, EventFailed}},
+		errors.New("canceled"))
+	if len(hook.payloads) != 2 {
+		t.Fatalf("payloads = %+v, want divergence and failed", hook.payloads)
+	}
+	divergence, failed := hook.payloads[0], hook.payloads[1]
+	if divergence.Event != EventDivergence || len(divergence.Tables) != 1 || divergence.Tables[0].Table != "t1" ||
+		divergence.Tables[0].Divergence() != 4 {
+		t.Errorf("divergence payload = %+v", divergence)
+	}
+	if failed.Event != EventFailed || failed.Error != "canceled" || len(failed.Tables) != 2 {
+		t.Errorf("failed payload = %+v", failed)
+	}
+}
@@ -0,0 +1,250 @@
+package dbsync
+
+import (
+	"../mydb"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+存储过程、函数、触发器和视图的比较:
+1) 两边分别用SHOW CREATE读取定义, 去掉DEFINER和当前库名的限定(`dba`.)
+2) 忽略缩进、行内多余的空白和空行后比较, 打印不一致对象的unified diff
+3) 可以生成让一边与另一边一致的脚本: 先DROP再CREATE, 另一边没有的对象只DROP
+*/
+
+// ObjectTypes are the compared object types, in the order of the script.
+var ObjectTypes = []string{"PROCEDURE", "FUNCTION", "TRIGGER", "VIEW"}
+
+type ObjectDiff struct {
+	Type, Name       string
+	Kind             string // ReviewLeftOnly/ReviewRightOnly/ReviewDiff
+	Create1, Create2 string // 去掉DEFINER后的定义, 不存在的一边为空
+}
+
+// CompareObjects compares the objects of ObjectTypes on both sides.
+func CompareObjects(ctx context.Context, db1, db2 *mydb.Db) ([]ObjectDiff, error) {
+	diffs := make([]ObjectDiff, 0)
+	for _, objectType := range ObjectTypes {
+		objects1, err := readObjects(ctx, db1, objectType)
+		if err != nil {
+			return nil, err
+		}
+		objects2, err := readObjects(ctx, db2, objectType)
+		if err != nil {
+			return nil, err
+		}
+
+		names := append([]string{}, objects1.names...)
+		for _, name := range objects2.names {
+			if _, ok := objects1.creates[name]; !ok {
+				names = append(names, name)
+			}
+		}
+
+		for _, name := range names {
+			diff := ObjectDiff{Type: objectType, Name: name, Kind: ReviewDiff}
+			create1, ok1 := objects1.creates[name]
+			create2, ok2 := objects2.creates[name]
+			switch {
+			case !ok2:
+				diff.Kind = ReviewLeftOnly
+			case !ok1:
+				diff.Kind = ReviewRightOnly
+			case normalizeDefinition(create1) == normalizeDefinition(create2):
+				continue
+			}
+
+			diff.Create1, diff.Create2 = create1, create2
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+type objectSet struct {
+	names   []string
+	creates map[string]string
+}
+
+func readObjects(ctx context.Context, db *mydb.Db, objectType string) (objectSet, error) {
+	objects := objectSet{creates: make(map[string]string)}
+	database, err := db.CurrentDatabase(ctx)
+	if err != nil {
+		return objects, err
+	}
+
+	if objects.names, err = db.ObjectNames(ctx, objectType); err != nil {
+		return objects, err
+	}
+	for _, name := range objects.names {
+		create, err := db.ShowCreate(ctx, objectType, name)
+		if err != nil {
+			return objects, err
+		}
+
+		create = definerRegexp.ReplaceAllString(create, "")
+		objects.creates[name] = strings.Replace(create, mydb.MySQL.Quote(database)+".", "", -1)
+	}
+
+	return objects, nil
+}
+
+var definerRegexp = regexp.MustCompile("(?i)\\s+DEFINER\\s*=\\s*(`[^`]*`@`[^`]*`|'[^']*'@'[^']*'|CURRENT_USER(\\(\\))?|[^\\s@]+@[^\\s]+)")
+
+var spacesRegexp = regexp.MustCompile("[ \t]+")
+
+// normalizeDefinition trims and collapses the spaces of every line, and
+// drops the empty lines.
+func normalizeDefinition(create string) string {
+	return strings.Join(definitionLines(create), "\n")
+}
+
+func definitionLines(create string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.Replace(create, "\r\n", "\n", -1), "\n") {
+		if line = strings.TrimSpace(spacesRegexp.ReplaceAllString(line, " ")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// UnifiedDiff shows the normalized definitions of Db1 and Db2 in the
+// unified diff format.
+func (diff ObjectDiff) UnifiedDiff() string {
+	name := strings.ToLower(diff.Type) + " " + diff.Name
+	lines1, lines2 := definitionLines(diff.Create1), definitionLines(diff.Create2)
+	return unifiedDiff("Db1 "+name, "Db2 "+name, lines1, lines2, 3)
+}
+
+type diffOp struct {
+	kind byte // ' ', '-', '+'
+	line string
+	a, b int // 在两边的行号, 从0开始
+}
+
+// diffLines finds the longest common subsequence of the lines.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i, j})
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	return ops
+}
+
+func unifiedDiff(name1, name2 string, a, b []string, context int) string {
+	ops := diffLines(a, b)
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %v\n+++ %v\n", name1, name2)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// 两处修改之间的相同行不超过2*context时合并为一个hunk
+		start, end := i-context, i
+		if start < 0 {
+			start = 0
+		}
+		for j := i; j < len(ops) && j-end <= 2*context; j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			}
+		}
+		stop := end + context + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		count1, count2 := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				count1++
+			}
+			if op.kind != '-' {
+				count2++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", hunkRange(ops[start].a, count1), hunkRange(ops[start].b, count2))
+		for _, op := range ops[start:stop] {
+			fmt.Fprintf(&out, "%c%v\n", op.kind, op.line)
+		}
+
+		i = stop
+	}
+
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%v,0", start)
+	}
+
+	return fmt.Sprintf("%v,%v", start+1, count)
+}
+
+// AlignScript makes the DROP/CREATE script which makes target ("Db1" or
+// "Db2") the same as the other side.
+func AlignScript(diffs []ObjectDiff, target string) string {
+	var out bytes.Buffer
+	source := "Db1"
+	if target == "Db1" {
+		source = "Db2"
+	}
+	fmt.Fprintf(&out, "-- align %v with %v\n", target, source)
+
+	for _, diff := range diffs {
+		create := diff.Create1
+		if target == "Db1" {
+			create = diff.Create2
+		}
+
+		fmt.Fprintf(&out, "\nDROP %v IF EXISTS %v;\n", diff.Type, mydb.MySQL.Quote(diff.Name))
+		switch {
+		case create == "":
+		case diff.Type == "VIEW":
+			fmt.Fprintf(&out, "%v;\n", create)
+		default:
+			// 存储过程、函数和触发器的定义中有分号
+			fmt.Fprintf(&out, "DELIMITER ;;\n%v;;\nDELIMITER ;\n", create)
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,37 @@
+package dbsync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, " ")
+	}
+
+	tests := []struct {
+		a, b    string
+		context int
+		want    string
+	}{
+		{"1 2 3", "1 2 3", 1, ""},
+		{"1 2 3 4 5 6 7 8 9 10", "1 2 3 x 5 6 7 8 9 10", 1, "@@ -3,3 +3,3 @@\n 3\n-4\n+x\n 5\n"},
+		// 相距超过2*context的修改分为两个hunk
+		{"1 2 3 4 5 6 7 8 9 10", "1 a 3 4 5 6 7 8 b 10", 1,
+			"@@ -1,3 +1,3 @@\n 1\n-2\n+a\n 3\n@@ -8,3 +8,3 @@\n 8\n-9\n+b\n 10\n"},
+		{"1 2 3 4 5 6 7 8 9 10", "1 a 3 b 5 6 7 8 9 10", 1, "@@ -1,5 +1,5 @@\n 1\n-2\n+a\n 3\n-4\n+b\n 5\n"},
+		{"", "x y", 3, "@@ -0,0 +1,2 @@\n+x\n+y\n"},
+		{"x y", "x", 3, "@@ -1,2 +1,1 @@\n x\n-y\n"},
+		{"x y", "", 3, "@@ -1,2 +0,0 @@\n-x\n-y\n"},
+	}
+	for _, test := range tests {
+		want := "--- Db1 view v\n+++ Db2 view v\n" + test.want
+		if got := unifiedDiff("Db1 view v", "Db2 view v", lines(test.a), lines(test.b), test.context); got != want {
+			t.Errorf("unifiedDiff(%q, %q) =\n%v\nwant\n%v", test.a, test.b, got, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package dbsync
+
+import (
+	"../mydb"
+	"../mynodb"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+自增主键冲突重映射(OnCollision = "remap"):
+1) 两边独立写入时, 同一个自增主键(例如id=1005)在两边是不相关的两行. 比较时该主键没有映射, 并且两行的RemapIdentity列不同, 即认为冲突,
+   RemapIdentity相同只是其它列不同时是同一行, 作为diff
+2) 冲突的两行在表比较结束后分别插入到对方, 由对方的自增列分配新主键, 映射关系保存在状态库中:
+   remap:<表>:Db2:<Db1主键> = <Db2主键>, remap:<表>:Db1:<Db2主键> = <Db1主键>
+3) 之后的比较都先按映射找到对方的行, 子表(RemapChildren)的外键列在比较和写入时也按映射改写
+*/
+
+const CollisionRemap = "remap"
+
+// KeyRemap is a row inserted to Side with a new key because Pk collided.
+type KeyRemap struct {
+	Side  string // Db1/Db2
+	Pk    string // 原主键
+	NewPk string
+}
+
+// keyMap is the key mapping of a table between Db1 and Db2.
+type keyMap struct {
+	state     mynodb.StateStore
+	tableName string
+}
+
+func (m keyMap) key(side, pk string) string {
+	return "remap:" + m.tableName + ":" + side + ":" + pk
+}
+
+// get returns the key in side of the pk of the other side.
+func (m keyMap) get(side, pk string) string {
+	if mapped, _ := m.state.Get(m.key(side, pk)); mapped != "" {
+		return mapped
+	}
+
+	return pk
+}
+
+func (m keyMap) set(pk1, pk2 string) error {
+	return m.state.SetBatch(map[string]string{m.key("Db2", pk1): pk2, m.key("Db1", pk2): pk1})
+}
+
+// fkRef is a column referencing the remapped key of the parent table.
+type fkRef struct {
+	column string
+	keys   keyMap
+}
+
+// fkRefs finds the columns of the table listed in the RemapChildren of the other tables.
+func fkRefs(tableName string, configs map[string]TableConfig, state mynodb.StateStore) []fkRef {
+	refs := make([]fkRef, 0)
+	for parent, config := range configs {
+		for _, child := range config.RemapChildren {
+			parts := strings.SplitN(child, ".", 2)
+			if len(parts) == 2 && parts[0] == tableName {
+				refs = append(refs, fkRef{parts[1], keyMap{state, parent}})
+			}
+		}
+	}
+
+	return refs
+}
+
+type collision struct {
+	pk         string
+	row1, row2 map[string]string // row1已按Db2映射过外键
+}
+
+func (syncParam *tableSync) remapEnabled() bool {
+	return syncParam.config.OnCollision == CollisionRemap
+}
+
+// mapRow copies the row of the other side with the key and the referencing
+// columns mapped into side.
+func (syncParam *tableSync) mapRow(side string, row map[string]string) map[string]string {
+	if !syncParam.remapEnabled() && len(syncParam.fkRefs) == 0 {
+		return row
+	}
+
+	mapped := copyRow(row)
+	if syncParam.remapEnabled() {
+		mapped[syncParam.pkCol] = syncParam.keys.get(side, row[syncParam.pkCol])
+	}
+	for _, ref := range syncParam.fkRefs {
+		if value, ok := row[ref.column]; ok && value != "NULL" {
+			mapped[ref.column] = ref.keys.get(side, value)
+		}
+	}
+
+	return mapped
+}
+
+// sameIdentity tells whether the rows of the same key are the same row by
+// the RemapIdentity columns.
+func (syncParam *tableSync) sameIdentity(row1, row2 map[string]string) bool {
+	identity1, identity2 := make(map[string]string), make(map[string]string)
+	for _, col := range syncParam.config.RemapIdentity {
+		identity1[col], identity2[col] = row1[col], row2[col]
+	}
+
+	return syncParam.rowsEqual(identity1, identity2)
+}
+
+// checkRemap checks the key is auto increment on both sides, and the
+// referencing and identity columns exist.
+func (syncParam *tableSync) checkRemap() error {
+	for _, ref := range syncParam.fkRefs {
+		if err := syncParam.table.CheckColumns(ref.column); err != nil {
+			return err
+		}
+	}
+
+	if !syncParam.remapEnabled() {
+		return nil
+	}
+	if err := syncParam.table.CheckColumns(syncParam.config.RemapIdentity...); err != nil {
+		return err
+	}
+
+	for _, db := range []*mydb.Db{syncParam.db1, syncParam.db2} {
+		autoIncrement, err := db.IsAutoIncrement(syncParam.ctx, syncParam.tableName, syncParam.pkCol)
+		if err != nil {
+			return err
+		}
+		if !autoIncrement {
+			return errors.New("remap needs the auto increment key, " + syncParam.tableName + "." +
+				syncParam.pkCol + " is not")
+		}
+	}
+
+	return nil
+}
+
+// remapCollisions inserts the collided rows to the other side with new keys,
+// after both sides are walked so that the new rows are not compared again.
+func (syncParam *tableSync) remapCollisions() error {
+	for _, c := range syncParam.collisions {
+		if err := syncParam.ctx.Err(); err != nil {
+			return err
+		}
+
+		pk2, err := syncParam.insertRemapped(syncParam.db2, "Db2", c.pk, c.row1)
+		if err != nil {
+			syncParam.onError(err)
+			continue
+		}
+		if err := syncParam.keys.set(c.pk, pk2); err != nil {
+			return err
+		}
+
+		if syncParam.options.OneWay {
+			continue
+		}
+
+		pk1, err := syncParam.insertRemapped(syncParam.db1, "Db1", c.pk, syncParam.mapRow("Db1", c.row2))
+		if err != nil {
+			syncParam.onError(err)
+			continue
+		}
+		if err := syncParam.keys.set(pk1, c.pk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (syncParam *tableSync) insertRemapped(db *mydb.Db, side, pk string, row map[string]string) (string, error) {
+	row = copyRow(row)
+	delete(row, syncParam.pkCol)
+	table := syncParam.tables1.tables[0]
+	if side == "Db2" {
+		table = syncParam.tables2.tables[0]
+	}
+	if err := syncParam.checkLossy(table, row); err != nil {
+		return "", err
+	}
+
+	// 新主键在插入后才知道, 在事务中插入, 记录回滚日志后才提交
+	tx, err := db.BeginTx(syncParam.ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	id, err := tx.InsertRowIdContext(syncParam.ctx, syncParam.tableName, row)
+	if err != nil {
+		return "", err
+	}
+
+	newPk := strconv.FormatInt(id, 10)
+	row[syncParam.pkCol] = newPk
+	entry := UndoEntry{Side: side, PkCol: syncParam.pkCol, Pk: newPk, Op: undoInsert, After: row}
+	if err := syncParam.recordUndo(entry); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		syncParam.failUndo(entry)
+		return "", err
+	}
+
+	syncParam.result.Remaps = append(syncParam.result.Remaps, KeyRemap{side, pk, newPk})
+	return newPk, nil
+}
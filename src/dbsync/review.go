@@ -0,0 +1,379 @@
+package dbsync
+
+import (
+	"../mydb"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+/*
+交互式审核:
+1) 以ReadOnly方式运行, 收集不一致的行和只在一边存在的行
+2) 逐行显示列级差异, 选择取Db1(l)、取Db2(r)、编辑合并值(e)或跳过(s), 大写的L/R/S对剩下的所有行生效, q结束审核
+3) 确认后在两边各开一个事务执行所有选择, 每行先加锁(select ... for update)重新读取, 与审核时的行不一致时放弃全部写入
+4) 都执行成功后先打印回滚运行ID, 记录Db2的回滚日志并提交Db2, 再记录Db1的回滚日志并提交Db1,
+   两边不是一个原子事务, Db2提交后Db1提交失败时可以按回滚日志回滚Db2
+*/
+
+const (
+	ReviewLeftOnly  = "left only"
+	ReviewRightOnly = "right only"
+	ReviewDiff      = "diff"
+
+	ChoiceLeft  = "left"  // Db2的行改成Db1的行
+	ChoiceRight = "right" // Db1的行改成Db2的行
+	ChoiceEdit  = "edit"  // 两边都改成编辑后的行
+	ChoiceSkip  = "skip"
+)
+
+type ReviewItem struct {
+	Kind       string
+	Table      string
+	Pk         string
+	Row1, Row2 map[string]string // 不存在的一边为nil
+}
+
+type ReviewAction struct {
+	ReviewItem
+	Choice string
+	Merged map[string]string // edit时编辑后的行
+}
+
+// Reviewer collects the differences as a Handler of a ReadOnly run, and asks
+// the operator what to do with each of them.
+type Reviewer struct {
+	NopHandler
+	db1, db2 *mydb.Db
+	in       *bufio.Reader
+	out      io.Writer
+	tables   map[string]*mydb.Table
+	pkCols   map[string]string
+	Items    []ReviewItem
+}
+
+func NewReviewer(db1, db2 *mydb.Db, in io.Reader, out io.Writer) *Reviewer {
+	return &Reviewer{
+		db1:    db1,
+		db2:    db2,
+		in:     bufio.NewReader(in),
+		out:    out,
+		tables: make(map[string]*mydb.Table),
+		pkCols: make(map[string]string),
+	}
+}
+
+func (r *Reviewer) OnLeftOnly(tableName, pk string, row map[string]string) {
+	r.Items = append(r.Items, ReviewItem{ReviewLeftOnly, tableName, pk, copyRow(row), nil})
+}
+
+func (r *Reviewer) OnRightOnly(tableName, pk string, row map[string]string) {
+	r.Items = append(r.Items, ReviewItem{ReviewRightOnly, tableName, pk, nil, copyRow(row)})
+}
+
+func (r *Reviewer) OnDiff(tableName, pk string, columns []string, row1, row2 map[string]string) {
+	r.Items = append(r.Items, ReviewItem{ReviewDiff, tableName, pk, copyRow(row1), copyRow(row2)})
+}
+
+func (r *Reviewer) OnError(tableName string, err error) {
+	fmt.Fprintln(r.out, tableName, err)
+}
+
+// table returns the table and its primary key column.
+func (r *Reviewer) table(ctx context.Context, tableName string) (*mydb.Table, string, error) {
+	if table, ok := r.tables[tableName]; ok {
+		return table, r.pkCols[tableName], nil
+	}
+
+	table, err := r.db1.Table(ctx, tableName)
+	if err != nil {
+		return nil, "", err
+	}
+	pk, err := r.db1.PrimaryKey(ctx, tableName)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(pk) != 1 {
+		return nil, "", fmt.Errorf("%v: a single column primary key is needed, found %v", tableName, pk)
+	}
+
+	r.tables[tableName], r.pkCols[tableName] = table, pk[0]
+	return table, pk[0], nil
+}
+
+// Review asks the choice of every item, and returns the actions to apply
+// after the operator confirms them, or nil.
+func (r *Reviewer) Review(ctx context.Context) ([]ReviewAction, error) {
+	actions := make([]ReviewAction, 0, len(r.Items))
+	all := ""
+	for i, item := range r.Items {
+		if all != "" {
+			actions = append(actions, ReviewAction{ReviewItem: item, Choice: all})
+			continue
+		}
+
+		table, pkCol, err := r.table(ctx, item.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		r.printItem(i, item, table.Columns, pkCol)
+		action, quit, err := r.choose(item, table.Columns, pkCol)
+		if err != nil {
+			return nil, err
+		}
+		if quit {
+			break
+		}
+
+		if strings.HasSuffix(action.Choice, "!") {
+			action.Choice = strings.TrimSuffix(action.Choice, "!")
+			all = action.Choice
+		}
+		actions = append(actions, action)
+	}
+
+	counts := make(map[string]int)
+	for _, action := range actions {
+		counts[action.Choice] += 1
+	}
+	fmt.Fprintf(r.out, "%v rows: %v left, %v right, %v edited, %v skipped\n", len(r.Items),
+		counts[ChoiceLeft], counts[ChoiceRight], counts[ChoiceEdit], len(r.Items)-len(actions)+counts[ChoiceSkip])
+	if len(actions) == counts[ChoiceSkip] {
+		return nil, nil
+	}
+
+	answer, err := r.ask("Apply in a transaction on each side? Db2 commits first and stays committed if Db1 fails (y/n): ")
+	if err != nil || answer != "y" {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+// choose reads the choice of the item, a choice for all the remaining items
+// ends with "!".
+func (r *Reviewer) choose(item ReviewItem, columns []string, pkCol string) (ReviewAction, bool, error) {
+	action := ReviewAction{ReviewItem: item}
+	for {
+		answer, err := r.ask("(l)eft (r)ight (e)dit (s)kip, L/R/S for all the remaining, (q)uit: ")
+		if err != nil {
+			return action, false, err
+		}
+
+		switch answer {
+		case "l", "r", "s", "L", "R", "S":
+			action.Choice = map[string]string{"l": ChoiceLeft, "r": ChoiceRight, "s": ChoiceSkip}[strings.ToLower(answer)]
+			if answer != strings.ToLower(answer) {
+				action.Choice += "!"
+			}
+			return action, false, nil
+		case "e":
+			action.Choice = ChoiceEdit
+			action.Merged, err = r.edit(item, columns, pkCol)
+			return action, false, err
+		case "q":
+			return action, true, nil
+		}
+	}
+}
+
+func (r *Reviewer) printItem(index int, item ReviewItem, columns []string, pkCol string) {
+	fmt.Fprintf(r.out, "[%v/%v] %v %v=%v %v\n", index+1, len(r.Items), item.Table, pkCol, item.Pk, item.Kind)
+	fmt.Fprintf(r.out, "  %-24v %-32v %v\n", "column", "Db1", "Db2")
+	for _, col := range columns {
+		v1, v2 := reviewValue(item.Row1, col), reviewValue(item.Row2, col)
+		mark := " "
+		if v1 != v2 {
+			mark = "*"
+		}
+		fmt.Fprintf(r.out, "%v %-24v %-32v %v\n", mark, col, v1, v2)
+	}
+}
+
+func reviewValue(row map[string]string, col string) string {
+	if row == nil {
+		return "-"
+	}
+
+	return row[col]
+}
+
+// edit asks the value of every differing column, the key is not editable.
+func (r *Reviewer) edit(item ReviewItem, columns []string, pkCol string) (map[string]string, error) {
+	base := item.Row1
+	if base == nil {
+		base = item.Row2
+	}
+
+	merged := copyRow(base)
+	for _, col := range columns {
+		if col == pkCol {
+			continue
+		}
+
+		v1, v2 := item.Row1[col], item.Row2[col]
+		var answer string
+		var err error
+		if item.Row1 != nil && item.Row2 != nil {
+			if v1 == v2 {
+				continue
+			}
+			answer, err = r.ask(fmt.Sprintf("  %v Db1=%v Db2=%v (Enter: Db1, >: Db2, or a new value): ", col, v1, v2))
+			if answer == ">" {
+				answer = v2
+			}
+		} else {
+			answer, err = r.ask(fmt.Sprintf("  %v=%v (Enter: keep, or a new value): ", col, base[col]))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if answer != "" {
+			merged[col] = answer
+		}
+	}
+
+	return merged, nil
+}
+
+func (r *Reviewer) ask(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	line, err := r.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Apply writes the actions in a transaction on each side, and fails when a
+// row is no longer the reviewed one. The two sides are not atomic: after all
+// the writes succeed, the undo entries of Db2 are recorded before Db2 is
+// committed, then the same for Db1, so a committed side can be rolled back
+// when the other fails. It returns the number of the committed rows.
+func (r *Reviewer) Apply(ctx context.Context, actions []ReviewAction, undo *UndoJournal) (int, error) {
+	tx1, err := r.db1.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx1.Rollback()
+
+	tx2, err := r.db2.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx2.Rollback()
+
+	entries1, entries2 := make([]UndoEntry, 0), make([]UndoEntry, 0)
+	put := func(tx *mydb.Tx, entries *[]UndoEntry, side string, table *mydb.Table, pkCol, pk string,
+		current, row map[string]string) error {
+		entry, err := putRow(ctx, tx, side, table, pkCol, pk, current, row)
+		if err == nil && entry.Op != "" {
+			*entries = append(*entries, entry)
+		}
+		return err
+	}
+
+	for _, action := range actions {
+		table, pkCol, err := r.table(ctx, action.Table)
+		if err != nil {
+			return 0, err
+		}
+
+		switch action.Choice {
+		case ChoiceLeft:
+			err = put(tx2, &entries2, "Db2", table, pkCol, action.Pk, action.Row2, action.Row1)
+		case ChoiceRight:
+			err = put(tx1, &entries1, "Db1", table, pkCol, action.Pk, action.Row1, action.Row2)
+		case ChoiceEdit:
+			if err = put(tx1, &entries1, "Db1", table, pkCol, action.Pk, action.Row1, action.Merged); err == nil {
+				err = put(tx2, &entries2, "Db2", table, pkCol, action.Pk, action.Row2, action.Merged)
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%v %v=%v: %v", action.Table, pkCol, action.Pk, err)
+		}
+	}
+
+	if undo != nil {
+		fmt.Fprintln(r.out, "Committing Db2, then Db1, undo run id "+undo.RunId)
+	}
+	if err := commitSide(tx2, entries2, undo); err != nil {
+		return 0, err
+	}
+	if err := commitSide(tx1, entries1, undo); err != nil {
+		return len(entries2), fmt.Errorf("Db2 is committed, Db1: %v", err)
+	}
+
+	return len(entries1) + len(entries2), nil
+}
+
+// commitSide records the entries in undo when it is not nil, then commits tx.
+func commitSide(tx *mydb.Tx, entries []UndoEntry, undo *UndoJournal) error {
+	if undo != nil {
+		for _, entry := range entries {
+			if err := undo.Record(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// putRow makes the current row of the side look like row, a nil row deletes
+// the current row. The current row is locked and must still be the reviewed
+// one.
+func putRow(ctx context.Context, tx *mydb.Tx, side string, table *mydb.Table, pkCol, pk string,
+	reviewed, row map[string]string) (UndoEntry, error) {
+	current, err := lockRow(ctx, tx, table, pkCol, pk)
+	if err != nil {
+		return UndoEntry{}, err
+	}
+	if !reflect.DeepEqual(current, reviewed) {
+		return UndoEntry{}, fmt.Errorf("the %v row is changed since the review", side)
+	}
+
+	entry := UndoEntry{Side: side, Table: table.Name, PkCol: pkCol, Pk: pk, Before: current, After: row}
+	switch {
+	case reflect.DeepEqual(current, row):
+		return UndoEntry{}, nil
+	case row == nil:
+		entry.Op = undoDelete
+		_, err = tx.DeleteRowContext(ctx, table.Name, pkCol, table.Infos[pkCol].Arg(pk))
+	case current == nil:
+		entry.Op = undoInsert
+		_, err = tx.InsertRowContext(ctx, table.Name, row)
+	default:
+		entry.Op = undoUpdate
+		_, err = tx.UpdateRowContext(ctx, table.Name, pkCol, table.Infos[pkCol].Arg(pk), row)
+	}
+
+	return entry, err
+}
+
+// lockRow reads the row of the key for update, or nil when it does not exist.
+func lockRow(ctx context.Context, tx *mydb.Tx, table *mydb.Table, pkCol, pk string) (map[string]string, error) {
+	sql, args, err := table.Select().Where(pkCol, "=", table.Infos[pkCol].Arg(pk)).ForUpdate().Sql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	columns, values, scans := mydb.MakeColumnsValues(rows)
+	return mydb.ReadRow(rows, columns, values, scans)
+}
@@ -0,0 +1,115 @@
+package dbsync
+
+import (
+	"../mydb"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+/*
+分表:
+一个逻辑表在某一边可以是按分片函数拆分的多个分表, 例如Db1中的tr_f_user_00..tr_f_user_63对应Db2中的tr_f_user.
+比较时依次遍历每个分表, 查找和写入时按行的分片列计算分表.
+*/
+
+const (
+	ShardMod   = "mod"   // 整数列值 % Count
+	ShardCrc32 = "crc32" // crc32(列值) % Count
+)
+
+type ShardConfig struct {
+	Pattern  string // 分表名的fmt格式, 例如"tr_f_user_%02d"
+	Count    int
+	Column   string // 分片列, 默认为主键
+	Function string // mod(默认)/crc32
+}
+
+func (shard ShardConfig) tableName(index int) string {
+	return fmt.Sprintf(shard.Pattern, index)
+}
+
+func (shard ShardConfig) index(value string) (int, error) {
+	switch shard.Function {
+	case "", ShardMod:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, errors.New("shard value " + value + " is not an integer")
+		}
+
+		count := int64(shard.Count)
+		return int((n%count + count) % count), nil
+	case ShardCrc32:
+		return int(crc32.ChecksumIEEE([]byte(value)) % uint32(shard.Count)), nil
+	}
+
+	return 0, errors.New("unknown shard function " + shard.Function)
+}
+
+func (shard ShardConfig) validate() error {
+	if shard.Count <= 0 {
+		return errors.New("shard Count must be positive")
+	}
+	// 缺少或多出格式化参数时fmt输出%!
+	if name := shard.tableName(0); strings.Contains(name, "%!") || name == shard.tableName(1) {
+		return errors.New("shard Pattern " + shard.Pattern + " has no index verb like %02d")
+	}
+	if shard.Function != "" && shard.Function != ShardMod && shard.Function != ShardCrc32 {
+		return errors.New("unknown shard Function " + shard.Function)
+	}
+
+	return nil
+}
+
+// tableSide is the physical tables of a logical table on one side.
+type tableSide struct {
+	tables []*mydb.Table // 不分表时只有一个
+	shard  *ShardConfig
+}
+
+func openTableSide(ctx context.Context, db *mydb.Db, tableName string, shard *ShardConfig) (tableSide, error) {
+	if shard == nil {
+		table, err := db.Table(ctx, tableName)
+		return tableSide{tables: []*mydb.Table{table}}, err
+	}
+
+	side := tableSide{shard: shard}
+	for i := 0; i < shard.Count; i++ {
+		table, err := db.Table(ctx, shard.tableName(i))
+		if err != nil {
+			return side, err
+		}
+
+		side.tables = append(side.tables, table)
+	}
+
+	if shard.Column != "" {
+		if err := side.tables[0].CheckColumns(shard.Column); err != nil {
+			return side, err
+		}
+	}
+
+	return side, nil
+}
+
+// route finds the table of the row.
+func (side tableSide) route(row map[string]string, pkCol string) (*mydb.Table, error) {
+	if side.shard == nil {
+		return side.tables[0], nil
+	}
+
+	col := side.shard.Column
+	if col == "" {
+		col = pkCol
+	}
+
+	index, err := side.shard.index(row[col])
+	if err != nil {
+		return nil, err
+	}
+
+	return side.tables[index], nil
+}
@@ -0,0 +1,91 @@
+package dbsync
+
+import (
+	"../mydb"
+	"testing"
+)
+
+func TestShardIndex(t *testing.T) {
+	tests := []struct {
+		shard ShardConfig
+		value string
+		want  int
+		ok    bool
+	}{
+		{ShardConfig{Count: 64}, "130", 2, true},
+		{ShardConfig{Count: 64, Function: ShardMod}, "64", 0, true},
+		{ShardConfig{Count: 4}, "-3", 1, true},
+		{ShardConfig{Count: 4}, "abc", 0, false},
+		{ShardConfig{Count: 64, Function: ShardCrc32}, "a045719884460976128", 1, true},
+		{ShardConfig{Count: 4, Function: ShardCrc32}, "abc", 2, true},
+		{ShardConfig{Count: 4, Function: "md5"}, "1", 0, false},
+	}
+	for _, test := range tests {
+		got, err := test.shard.index(test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("%v index(%q) = %v, %v, want %v, ok %v", test.shard.Function, test.value, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestShardTableName(t *testing.T) {
+	shard := ShardConfig{Pattern: "tr_f_user_%02d", Count: 64}
+	for index, want := range map[int]string{0: "tr_f_user_00", 7: "tr_f_user_07", 63: "tr_f_user_63"} {
+		if got := shard.tableName(index); got != want {
+			t.Errorf("tableName(%v) = %v, want %v", index, got, want)
+		}
+	}
+}
+
+func TestShardValidate(t *testing.T) {
+	tests := []struct {
+		shard ShardConfig
+		ok    bool
+	}{
+		{ShardConfig{Pattern: "tr_f_user_%02d", Count: 64}, true},
+		{ShardConfig{Pattern: "tr_f_user_%d", Count: 2, Function: ShardCrc32}, true},
+		{ShardConfig{Pattern: "tr_f_user", Count: 2}, false},
+		{ShardConfig{Pattern: "tr_f_user_%02d_%02d", Count: 2}, false},
+		{ShardConfig{Pattern: "tr_f_user_%02d", Count: 0}, false},
+		{ShardConfig{Pattern: "tr_f_user_%02d", Count: 2, Function: "md5"}, false},
+	}
+	for _, test := range tests {
+		if err := test.shard.validate(); (err == nil) != test.ok {
+			t.Errorf("validate(%+v) = %v, want ok %v", test.shard, err, test.ok)
+		}
+	}
+}
+
+func TestTableSideRoute(t *testing.T) {
+	shard := &ShardConfig{Pattern: "tr_f_order_%d", Count: 4, Column: "user_id"}
+	side := tableSide{shard: shard}
+	for i := 0; i < shard.Count; i++ {
+		side.tables = append(side.tables, &mydb.Table{Name: shard.tableName(i)})
+	}
+
+	tests := []struct {
+		row  map[string]string
+		want string
+		ok   bool
+	}{
+		{map[string]string{"order_id": "100", "user_id": "7"}, "tr_f_order_3", true},
+		{map[string]string{"order_id": "101", "user_id": "8"}, "tr_f_order_0", true},
+		{map[string]string{"order_id": "102", "user_id": "x"}, "", false},
+	}
+	for _, test := range tests {
+		table, err := side.route(test.row, "order_id")
+		if (err == nil) != test.ok || (err == nil && table.Name != test.want) {
+			t.Errorf("route(%v) = %v, %v, want %v", test.row, table, err, test.want)
+		}
+	}
+
+	// 不配置Column时按主键, 不分表时只有一个表
+	shard.Column = ""
+	if table, err := side.route(map[string]string{"order_id": "6"}, "order_id"); err != nil || table.Name != "tr_f_order_2" {
+		t.Errorf("route by the key = %v, %v, want tr_f_order_2", table, err)
+	}
+	single := tableSide{tables: []*mydb.Table{{Name: "tr_f_order"}}}
+	if table, err := single.route(map[string]string{"order_id": "x"}, "order_id"); err != nil || table.Name != "tr_f_order" {
+		t.Errorf("route without shards = %v, %v, want tr_f_order", table, err)
+	}
+}
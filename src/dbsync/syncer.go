@@ -0,0 +1,688 @@
+package dbsync
+
+import (
+	"../mydb"
+	"../mynodb"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const PK = "_PK_"
+const PK_COL = "_PK_COL_"
+
+const defaultPageSize = 1000
+
+const (
+	pkMerged = "1" // 已补充到Db2
+	pkSame   = "2"
+	pkDiff   = "3"
+)
+
+type WriteMode string
+
+const (
+	WriteInsert WriteMode = "insert"
+	// WriteUpsert writes with INSERT ... ON DUPLICATE KEY UPDATE (ON CONFLICT),
+	// so that rows inserted concurrently do not fail the sync.
+	WriteUpsert WriteMode = "upsert"
+)
+
+type Options struct {
+	Db1, Db2  *mydb.Db
+	Tables    []string
+	Handler   Handler
+	WriteMode WriteMode
+	// OneWay only makes Db2 look like Db1: the rows only in Db2 are left
+	// alone, and in upsert mode the diff rows of Db2 are updated from Db1.
+	OneWay       bool
+	TableConfigs map[string]TableConfig
+	// State keeps the Merkle leaf bounds and node hashes between runs, a temp store is used when nil.
+	State mynodb.StateStore
+	// StateBackend is the backend of the temp store, see mynodb.OpenStore.
+	StateBackend string
+	// PageSize is the row count of each keyset paginated query, 1000 by default.
+	PageSize int
+	// Snapshot reads each side in a consistent snapshot taken when Run starts,
+	// the writes go through other connections.
+	Snapshot bool
+	// Undo records the inserted and updated rows for Rollback when not nil.
+	Undo *UndoJournal
+	// ReadOnly only reports the differences to the Handler, nothing is
+	// written, LeftOnly/RightOnly of the result are the rows found.
+	ReadOnly bool
+	// Verify recomputes the row counts and checksums of both sides after
+	// each table is merged, Run fails when a table still diverges.
+	Verify bool
+	// Normalize compares the text by the collations of the columns and skips
+	// the writes which the charset of the target column can not keep, the
+	// connections should be opened with Config.DataSources.
+	Normalize bool
+	// CountRows counts the rows of both sides after each table for the
+	// Rows1 and Rows2 of TableResult.
+	CountRows bool
+	// Changelog only compares the keys in the changelog tables filled by the
+	// triggers of SetupChangelog, and deletes the rows deleted on the other side.
+	Changelog bool
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error)
+}
+
+// syncRun is the state shared by the tables of a Run.
+type syncRun struct {
+	nodb         mynodb.StateStore
+	state        mynodb.StateStore
+	read1, read2 querier
+	pos1, pos2   *mydb.BinlogPos
+}
+
+// Syncer compares the tables of Db1 and Db2, and copies the rows which
+// exist on only one side to the other side.
+type Syncer struct {
+	options Options
+}
+
+func NewSyncer(options Options) (*Syncer, error) {
+	if options.Db1 == nil || options.Db2 == nil {
+		return nil, errors.New("dbsync: Db1 and Db2 are required")
+	}
+
+	if options.Handler == nil {
+		options.Handler = NopHandler{}
+	}
+
+	if options.PageSize <= 0 {
+		options.PageSize = defaultPageSize
+	}
+
+	switch options.WriteMode {
+	case "":
+		options.WriteMode = WriteInsert
+	case WriteInsert, WriteUpsert:
+	default:
+		return nil, errors.New("dbsync: unknown write mode " + string(options.WriteMode))
+	}
+
+	for tableName, config := range options.TableConfigs {
+		if config.OnCollision == CollisionRemap && options.State == nil {
+			return nil, errors.New("dbsync: remap of " + tableName + " needs the persistent State")
+		}
+	}
+	if problems := childOrderProblems(options.Tables, options.TableConfigs); len(problems) > 0 {
+		return nil, errors.New("dbsync: " + strings.Join(problems, "; "))
+	}
+
+	return &Syncer{options}, nil
+}
+
+// Run syncs the tables one by one. It stops when ctx is canceled and
+// returns the first table error otherwise.
+func (syncer *Syncer) Run(ctx context.Context) error {
+	nodb, err := mynodb.OpenTempStore(syncer.options.StateBackend)
+	if err != nil {
+		return err
+	}
+	defer nodb.Close()
+
+	run := &syncRun{nodb: nodb, state: syncer.options.State, read1: syncer.options.Db1, read2: syncer.options.Db2}
+	if run.state == nil {
+		run.state = nodb
+	}
+
+	if syncer.options.Snapshot {
+		snapshot1, err := syncer.options.Db1.BeginSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		defer snapshot1.Close()
+
+		snapshot2, err := syncer.options.Db2.BeginSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		defer snapshot2.Close()
+
+		run.read1, run.pos1 = snapshot1, &snapshot1.Pos
+		run.read2, run.pos2 = snapshot2, &snapshot2.Pos
+	}
+
+	var firstErr error
+	diverged := make([]string, 0)
+	for _, tableName := range syncer.options.Tables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		result := syncer.syncTable(ctx, run, tableName)
+		syncer.options.Handler.OnTableDone(result)
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if result.Err != nil && firstErr == nil {
+			firstErr = result.Err
+		}
+		if result.Verify != nil && result.Verify.Diverged {
+			diverged = append(diverged, tableName)
+		}
+	}
+
+	if firstErr == nil && len(diverged) > 0 {
+		return errors.New("dbsync: tables still diverge after sync: " + strings.Join(diverged, ", "))
+	}
+
+	return firstErr
+}
+
+func (syncer *Syncer) syncTable(parent context.Context, run *syncRun, tableName string) TableResult {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	syncParam := &tableSync{
+		ctx:       ctx,
+		db1:       syncer.options.Db1,
+		db2:       syncer.options.Db2,
+		read1:     run.read1,
+		read2:     run.read2,
+		tableName: tableName,
+		nodb:      run.nodb,
+		state:     run.state,
+		handler:   syncer.options.Handler,
+		options:   syncer.options,
+		config:    syncer.options.TableConfigs[tableName],
+		rowChan1:  make(chan map[string]string),
+		rowChan2:  make(chan map[string]string),
+	}
+	syncParam.result.TableName = tableName
+	syncParam.result.Snapshot1, syncParam.result.Snapshot2 = run.pos1, run.pos2
+
+	startTime := time.Now()
+	err := syncParam.sync()
+	if err == nil && syncParam.options.Verify && !syncParam.options.ReadOnly {
+		syncParam.result.Verify, err = syncParam.verify()
+	}
+	if err == nil && syncParam.options.CountRows {
+		err = syncParam.countRows()
+	}
+	syncParam.result.Duration = time.Now().Sub(startTime)
+	syncParam.result.Err = err
+
+	return syncParam.result
+}
+
+type tableSync struct {
+	ctx        context.Context
+	db1        *mydb.Db
+	db2        *mydb.Db
+	read1      querier // 读Db1, 快照模式下为快照连接
+	read2      querier
+	tableName  string
+	nodb       mynodb.StateStore
+	state      mynodb.StateStore
+	handler    Handler
+	options    Options
+	config     TableConfig
+	ranges     []pkRange   // 只比较这些主键区间, 为nil时比较全表
+	changes    *changeSet  // Changelog模式下只比较这些主键
+	table      *mydb.Table // Db1的第一个表, 用于取列
+	tables1    tableSide
+	tables2    tableSide
+	pkCol      string
+	keys       keyMap      // 本表主键的映射
+	fkRefs     []fkRef     // 引用其它表重映射主键的列
+	collisions []collision // 等待重映射的主键冲突
+	rowChan1   chan map[string]string
+	rowChan2   chan map[string]string
+	walkErr    error
+	result     TableResult
+}
+
+func (syncParam *tableSync) sync() error {
+	var err error
+	syncParam.tables1, err = openTableSide(syncParam.ctx, syncParam.db1, syncParam.tableName, syncParam.config.Db1Shard)
+	if err != nil {
+		return err
+	}
+	syncParam.tables2, err = openTableSide(syncParam.ctx, syncParam.db2, syncParam.tableName, syncParam.config.Db2Shard)
+	if err != nil {
+		return err
+	}
+
+	table := syncParam.tables1.tables[0]
+	if err := table.CheckColumns(syncParam.config.UpdateColumns...); err != nil {
+		return err
+	}
+	pk, err := syncParam.db1.PrimaryKey(syncParam.ctx, table.Name)
+	if err != nil {
+		return err
+	}
+	if len(pk) != 1 {
+		return fmt.Errorf("%v needs a single column primary key, found %v", table.Name, pk)
+	}
+	syncParam.table, syncParam.pkCol = table, pk[0]
+	syncParam.keys = keyMap{syncParam.state, syncParam.tableName}
+	syncParam.fkRefs = fkRefs(syncParam.tableName, syncParam.options.TableConfigs, syncParam.state)
+	if err := syncParam.checkRemap(); err != nil {
+		return err
+	}
+
+	if syncParam.options.Changelog {
+		if syncParam.changes, err = syncParam.readChanges(); err != nil {
+			return err
+		}
+		if len(syncParam.changes.keys) == 0 {
+			return nil
+		}
+	} else if syncParam.config.MerkleLeafRows > 0 {
+		tree, err := newMerkleTree(syncParam.ctx, syncParam.read1, syncParam.read2, syncParam.state,
+			table, syncParam.pkCol, syncParam.config.MerkleLeafRows)
+		if err != nil {
+			return err
+		}
+
+		if syncParam.ranges, err = tree.diff(); err != nil {
+			return err
+		}
+
+		syncParam.result.DiffRanges = len(syncParam.ranges)
+		if len(syncParam.ranges) == 0 {
+			return nil
+		}
+	}
+
+	go syncParam.walkDb1()
+	if err := syncParam.mergeToDb2(); err != nil {
+		return err
+	}
+
+	if !syncParam.options.OneWay {
+		go syncParam.walkDb2()
+		if err := syncParam.mergeToDb1(); err != nil {
+			return err
+		}
+	}
+
+	if err := syncParam.remapCollisions(); err != nil {
+		return err
+	}
+
+	// 有写入失败的行时保留changelog, 下一次运行重新处理
+	if syncParam.changes != nil && !syncParam.options.ReadOnly && syncParam.result.Errors == 0 {
+		return syncParam.commitChanges()
+	}
+
+	return nil
+}
+
+func (syncParam *tableSync) nodbKey(pk string) string {
+	return syncParam.tableName + ":" + pk
+}
+
+func (syncParam *tableSync) walkDb2() {
+	defer close(syncParam.rowChan2)
+	syncParam.walkErr = syncParam.walk(syncParam.read2, syncParam.tables2, syncParam.rowChan2, func(pk string) bool {
+		return !syncParam.nodb.Exists(syncParam.nodbKey(pk))
+	})
+}
+
+func (syncParam *tableSync) walkDb1() {
+	defer close(syncParam.rowChan1)
+	syncParam.walkErr = syncParam.walk(syncParam.read1, syncParam.tables1, syncParam.rowChan1, nil)
+}
+
+// walk walks the tables of the side one after another.
+func (syncParam *tableSync) walk(db querier, side tableSide, rowChan chan map[string]string,
+	accept func(pk string) bool) error {
+	ranges := syncParam.ranges
+	if ranges == nil {
+		ranges = []pkRange{{}}
+	}
+
+	for _, table := range side.tables {
+		if syncParam.changes != nil {
+			if err := syncParam.walkKeys(db, table, rowChan, accept); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, r := range ranges {
+			if err := syncParam.walkRange(db, table, rowChan, accept, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// walkRange sends the rows in the range to rowChan page by page, the primary
+// key is kept under the PK/PK_COL keys of the row.
+func (syncParam *tableSync) walkRange(db querier, table *mydb.Table, rowChan chan map[string]string,
+	accept func(pk string) bool, r pkRange) error {
+	last, hasLast := "", false
+	for {
+		page, err := syncParam.queryPage(db, table, r, last, hasLast)
+		if err != nil {
+			return err
+		}
+
+		if err := syncParam.sendPage(page, rowChan, accept); err != nil {
+			return err
+		}
+
+		if len(page) < syncParam.options.PageSize {
+			return nil
+		}
+
+		last, hasLast = page[len(page)-1][PK], true
+	}
+}
+
+func (syncParam *tableSync) sendPage(page []map[string]string, rowChan chan map[string]string,
+	accept func(pk string) bool) error {
+	for _, row := range page {
+		if accept != nil && !accept(row[PK]) {
+			continue
+		}
+
+		select {
+		case rowChan <- row:
+		case <-syncParam.ctx.Done():
+			return syncParam.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// queryPage reads the next page after the last primary key, the result set
+// is closed before the rows are merged, so that no long read is kept open.
+func (syncParam *tableSync) queryPage(db querier, table *mydb.Table, r pkRange, last string,
+	hasLast bool) ([]map[string]string, error) {
+	pk := table.Infos[syncParam.pkCol]
+	query := r.where(table.Select(), pk)
+	if hasLast {
+		query.Where(pk.Name, ">", pk.Arg(last))
+	}
+
+	return syncParam.readPage(db, query.OrderBy(syncParam.pkCol).Limit(syncParam.options.PageSize))
+}
+
+// readPage reads the rows of the query, the primary key is kept under the
+// PK/PK_COL keys of the row.
+func (syncParam *tableSync) readPage(db querier, query *mydb.Query) ([]map[string]string, error) {
+	sql, args, err := query.Sql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(syncParam.ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]map[string]string, 0, syncParam.options.PageSize)
+	columns, values, scans := mydb.MakeColumnsValues(rows)
+	for rows.Next() {
+		row, err := mydb.ReadRow(rows, columns, values, scans)
+		if err != nil {
+			return nil, err
+		}
+
+		row[PK] = row[syncParam.pkCol]
+		row[PK_COL] = syncParam.pkCol
+		page = append(page, row)
+	}
+
+	return page, rows.Err()
+}
+
+func (syncParam *tableSync) mergeToDb1() error {
+	for row2 := range syncParam.rowChan2 {
+		pk := row2[PK]
+		delete(row2, PK)
+		pkCol := row2[PK_COL]
+		delete(row2, PK_COL)
+
+		mapped := syncParam.mapRow("Db1", row2)
+		if syncParam.changes.deleted("Db1", mapped[pkCol]) {
+			table2, err := syncParam.tables2.route(row2, pkCol)
+			if err == nil {
+				err = syncParam.deleteRow(syncParam.db2, "Db2", table2, pkCol, row2)
+			}
+			if err != nil {
+				syncParam.onError(err)
+			}
+			continue
+		}
+
+		table1, err := syncParam.tables1.route(mapped, pkCol)
+		if err == nil {
+			err = syncParam.writeRow(syncParam.db1, "Db1", table1, pkCol, mapped)
+		}
+		if err != nil {
+			syncParam.onError(err)
+			continue
+		}
+
+		syncParam.result.RightOnly += 1
+		syncParam.handler.OnRightOnly(syncParam.tableName, pk, row2)
+	}
+
+	return syncParam.walkResult()
+}
+
+func (syncParam *tableSync) mergeToDb2() error {
+	for row1 := range syncParam.rowChan1 {
+		if err := syncParam.mergeRowToDb2(row1); err != nil {
+			return err
+		}
+	}
+
+	return syncParam.walkResult()
+}
+
+func (syncParam *tableSync) walkResult() error {
+	if err := syncParam.ctx.Err(); err != nil {
+		return err
+	}
+
+	return syncParam.walkErr
+}
+
+func (syncParam *tableSync) mergeRowToDb2(row1 map[string]string) error {
+	pk := row1[PK]
+	delete(row1, PK)
+	pkCol := row1[PK_COL]
+	delete(row1, PK_COL)
+
+	// 按映射后的主键查找Db2中对应的行, 映射后的行用于比较和写入
+	mapped := syncParam.mapRow("Db2", row1)
+	pk2 := mapped[pkCol]
+	table2, err := syncParam.tables2.route(mapped, pkCol)
+	if err != nil {
+		syncParam.onError(err)
+		return nil
+	}
+
+	sql, args, err := table2.Select().Where(pkCol, "=", table2.Infos[pkCol].Arg(pk2)).Limit(1).Sql()
+	if err != nil {
+		return err
+	}
+
+	rows, err := syncParam.read2.QueryContext(syncParam.ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, values, scans := mydb.MakeColumnsValues(rows)
+	if rows.Next() {
+		row2, err := mydb.ReadRow(rows, columns, values, scans)
+		if err != nil {
+			return err
+		}
+
+		if syncParam.remapEnabled() && !syncParam.options.ReadOnly && pk2 == pk && !syncParam.sameIdentity(mapped, row2) {
+			syncParam.nodb.Set(syncParam.nodbKey(pk2), pkDiff)
+			syncParam.collisions = append(syncParam.collisions, collision{pk, mapped, row2})
+			return nil
+		}
+
+		if syncParam.compareRow(pk2, columns, mapped, row2) && syncParam.updatesDiff() {
+			if err := syncParam.writeRow(syncParam.db2, "Db2", table2, pkCol, mapped); err != nil {
+				syncParam.onError(err)
+				return nil
+			}
+
+			syncParam.result.Updated += 1
+		}
+		return nil
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !syncParam.options.OneWay && syncParam.changes.deleted("Db2", pk2) {
+		table1, err := syncParam.tables1.route(row1, pkCol)
+		if err == nil {
+			err = syncParam.deleteRow(syncParam.db1, "Db1", table1, pkCol, row1)
+		}
+		if err != nil {
+			syncParam.onError(err)
+		}
+		syncParam.nodb.Set(syncParam.nodbKey(pk2), pkMerged)
+		return nil
+	}
+
+	if err := syncParam.writeRow(syncParam.db2, "Db2", table2, pkCol, mapped); err != nil {
+		syncParam.onError(err)
+		return nil
+	}
+	syncParam.nodb.Set(syncParam.nodbKey(pk2), pkMerged)
+	syncParam.result.LeftOnly += 1
+	syncParam.handler.OnLeftOnly(syncParam.tableName, pk, row1)
+	return nil
+}
+
+// compareRow returns true when the rows differ.
+func (syncParam *tableSync) compareRow(pk string, columns []string, row1, row2 map[string]string) bool {
+	if syncParam.rowsEqual(row1, row2) {
+		syncParam.nodb.Set(syncParam.nodbKey(pk), pkSame)
+		return false
+	}
+
+	syncParam.nodb.Set(syncParam.nodbKey(pk), pkDiff)
+	syncParam.result.Diffs += 1
+	syncParam.handler.OnDiff(syncParam.tableName, pk, columns, row1, row2)
+	return true
+}
+
+func (syncParam *tableSync) updatesDiff() bool {
+	return !syncParam.options.ReadOnly && syncParam.options.OneWay && syncParam.options.WriteMode == WriteUpsert
+}
+
+// writeRow records the undo entry before writing the row, so that a crash
+// after the write does not lose the entry, and marks the entry failed when
+// the write fails.
+func (syncParam *tableSync) writeRow(db *mydb.Db, side string, table *mydb.Table, pkCol string,
+	row map[string]string) error {
+	if syncParam.options.ReadOnly {
+		return nil
+	}
+	if err := syncParam.checkLossy(table, row); err != nil {
+		return err
+	}
+	entry, err := syncParam.writeEntry(db, side, table, pkCol, row)
+	if err != nil {
+		return err
+	}
+	if err := syncParam.recordUndo(entry); err != nil {
+		return err
+	}
+
+	tableName := table.Name
+
+	if syncParam.options.WriteMode == WriteUpsert {
+		_, err = db.UpsertRowContext(syncParam.ctx, tableName,
+			[]string{pkCol}, row, syncParam.updateColumns(pkCol, row))
+	} else {
+		_, err = db.InsertRowContext(syncParam.ctx, tableName, row)
+	}
+	if err != nil {
+		syncParam.failUndo(entry)
+	}
+
+	return err
+}
+
+// writeEntry makes the undo entry of the row to write, an upsert over an
+// existing row is recorded as an update to the row as actually written.
+func (syncParam *tableSync) writeEntry(db *mydb.Db, side string, table *mydb.Table, pkCol string,
+	row map[string]string) (UndoEntry, error) {
+	entry := UndoEntry{Side: side, Table: table.Name, PkCol: pkCol, Pk: row[pkCol], Op: undoInsert, After: row}
+	if syncParam.options.Undo == nil || syncParam.options.WriteMode != WriteUpsert {
+		return entry, nil
+	}
+
+	current, found, err := findRow(syncParam.ctx, db, table, pkCol, entry.Pk)
+	if err != nil || !found {
+		return entry, err
+	}
+
+	entry.Op, entry.Before, entry.After = undoUpdate, current, copyRow(current)
+	for _, col := range syncParam.updateColumns(pkCol, row) {
+		entry.After[col] = row[col]
+	}
+	return entry, nil
+}
+
+func (syncParam *tableSync) updateColumns(pkCol string, row map[string]string) []string {
+	if cols := syncParam.config.UpdateColumns; cols != nil {
+		return cols
+	}
+
+	cols := make([]string, 0, len(row))
+	for col := range row {
+		if col != pkCol {
+			cols = append(cols, col)
+		}
+	}
+
+	return cols
+}
+
+// recordUndo is called before the write, the write is skipped when the entry
+// can not be recorded.
+func (syncParam *tableSync) recordUndo(entry UndoEntry) error {
+	if syncParam.options.Undo == nil || syncParam.options.ReadOnly {
+		return nil
+	}
+
+	if entry.Table == "" {
+		entry.Table = syncParam.tableName
+	}
+
+	return syncParam.options.Undo.Record(entry)
+}
+
+// failUndo records that the write of the entry failed, Rollback skips the
+// entry.
+func (syncParam *tableSync) failUndo(entry UndoEntry) {
+	entry.Op, entry.Before, entry.After = undoFailed, nil, nil
+	if err := syncParam.recordUndo(entry); err != nil {
+		syncParam.onError(err)
+	}
+}
+
+func (syncParam *tableSync) onError(err error) {
+	syncParam.result.Errors += 1
+	syncParam.handler.OnError(syncParam.tableName, err)
+}
@@ -0,0 +1,272 @@
+package dbsync
+
+import (
+	"../mydb"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+回滚日志:
+每次运行在UndoDir下生成一个<运行ID>.jsonl文件, 每行记录一次插入、更新或删除, 包括更新或删除前的行.
+记录在写入之前(重映射的插入在提交之前), 写入失败时再追加一条failed记录, 回滚时跳过对应的记录.
+upsert覆盖已有的行时记录为更新, 包括更新前的行和实际写入后的行.
+回滚时倒序处理, 只有当前行与写入后的行一致时才删除插入的行或者恢复更新前的行, 删除的行只在仍不存在时重新插入, 否则跳过并报告.
+回滚结束后生成<运行ID>.rolledback, 其中记录回滚时间和跳过的行.
+*/
+
+const (
+	undoInsert = "insert"
+	undoUpdate = "update"
+	undoDelete = "delete"
+	undoFailed = "failed" // 前一条相同主键的记录写入失败
+
+	undoExt       = ".jsonl"
+	rolledBackExt = ".rolledback"
+)
+
+type UndoEntry struct {
+	Side   string // Db1/Db2
+	Table  string
+	PkCol  string
+	Pk     string
+	Op     string            // insert/update/delete/failed
+	Before map[string]string `json:",omitempty"`
+	After  map[string]string `json:",omitempty"`
+}
+
+type UndoJournal struct {
+	RunId string
+	mutex sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+}
+
+// OpenUndoJournal starts the journal of a new run in dir.
+func OpenUndoJournal(dir string) (*UndoJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// daemon模式下多个表可能同时开始, 运行ID重复时加序号
+	baseId := time.Now().Format("20060102-150405.000")
+	runId := baseId
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(filepath.Join(dir, runId+undoExt), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return &UndoJournal{RunId: runId, file: file, enc: json.NewEncoder(file)}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		runId = baseId + "-" + strconv.Itoa(i)
+	}
+}
+
+func (journal *UndoJournal) Record(entry UndoEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.enc.Encode(entry)
+}
+
+func (journal *UndoJournal) Close() error {
+	return journal.file.Close()
+}
+
+type UndoRun struct {
+	RunId      string
+	Inserts    int
+	Updates    int
+	Deletes    int
+	Failed     int // 写入失败的记录, 也计入插入、更新或删除
+	RolledBack bool
+}
+
+func ListUndoRuns(dir string) ([]UndoRun, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	runs := make([]UndoRun, 0)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), undoExt) {
+			continue
+		}
+
+		run := UndoRun{RunId: strings.TrimSuffix(file.Name(), undoExt)}
+		entries, err := readUndoEntries(dir, run.RunId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			switch entry.Op {
+			case undoInsert:
+				run.Inserts += 1
+			case undoDelete:
+				run.Deletes += 1
+			case undoFailed:
+				run.Failed += 1
+			default:
+				run.Updates += 1
+			}
+		}
+
+		_, err = os.Stat(filepath.Join(dir, run.RunId+rolledBackExt))
+		run.RolledBack = err == nil
+		runs = append(runs, run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].RunId < runs[j].RunId })
+	return runs, nil
+}
+
+func readUndoEntries(dir, runId string) ([]UndoEntry, error) {
+	file, err := os.Open(filepath.Join(dir, runId+undoExt))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]UndoEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		entry := UndoEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+type RollbackResult struct {
+	Reverted  int
+	Conflicts []string // 已被其它写入修改而跳过的行
+}
+
+// Rollback reverts the rows written by the run in the reverse order.
+func Rollback(ctx context.Context, dir, runId string, db1, db2 *mydb.Db) (RollbackResult, error) {
+	result := RollbackResult{}
+	if _, err := os.Stat(filepath.Join(dir, runId+rolledBackExt)); err == nil {
+		return result, errors.New("run " + runId + " is already rolled back")
+	}
+
+	entries, err := readUndoEntries(dir, runId)
+	if err != nil {
+		return result, err
+	}
+
+	tables := make(map[string]*mydb.Table)
+	failed := make(map[string]int)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		db := db1
+		if entry.Side == "Db2" {
+			db = db2
+		}
+
+		// 倒序时failed记录在对应的记录之前
+		entryKey := entry.Side + ":" + entry.Table + ":" + entry.Pk
+		if entry.Op == undoFailed {
+			failed[entryKey] += 1
+			continue
+		}
+		if failed[entryKey] > 0 {
+			failed[entryKey] -= 1
+			continue
+		}
+
+		key := entry.Side + ":" + entry.Table
+		if tables[key] == nil {
+			if tables[key], err = db.Table(ctx, entry.Table); err != nil {
+				return result, err
+			}
+		}
+
+		reverted, err := revertEntry(ctx, db, tables[key], entry)
+		if err != nil {
+			return result, err
+		}
+
+		if reverted {
+			result.Reverted += 1
+		} else {
+			result.Conflicts = append(result.Conflicts, entry.Side+" "+entry.Table+" "+entry.PkCol+"="+entry.Pk)
+		}
+	}
+
+	marker := time.Now().String() + "\n"
+	for _, conflict := range result.Conflicts {
+		marker += "conflict " + conflict + "\n"
+	}
+
+	return result, ioutil.WriteFile(filepath.Join(dir, runId+rolledBackExt), []byte(marker), 0644)
+}
+
+func revertEntry(ctx context.Context, db *mydb.Db, table *mydb.Table, entry UndoEntry) (bool, error) {
+	current, found, err := findRow(ctx, db, table, entry.PkCol, entry.Pk)
+	if err != nil {
+		return false, err
+	}
+	if entry.Op == undoDelete {
+		if found {
+			return false, nil
+		}
+
+		_, err = db.InsertRowContext(ctx, entry.Table, entry.Before)
+		return err == nil, err
+	}
+	if !found || !reflect.DeepEqual(current, entry.After) {
+		return false, nil
+	}
+
+	pk := table.Infos[entry.PkCol].Arg(entry.Pk)
+	if entry.Op == undoInsert {
+		_, err = db.DeleteRowContext(ctx, entry.Table, entry.PkCol, pk)
+	} else {
+		_, err = db.UpdateRowContext(ctx, entry.Table, entry.PkCol, pk, entry.Before)
+	}
+
+	return err == nil, err
+}
+
+func findRow(ctx context.Context, db querier, table *mydb.Table, pkCol, pk string) (map[string]string, bool, error) {
+	sql, args, err := table.Select().Where(pkCol, "=", table.Infos[pkCol].Arg(pk)).Limit(1).Sql()
+	if err != nil {
+		return nil, false, err
+	}
+
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+
+	columns, values, scans := mydb.MakeColumnsValues(rows)
+	row, err := mydb.ReadRow(rows, columns, values, scans)
+	return row, err == nil, err
+}
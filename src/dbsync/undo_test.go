@@ -0,0 +1,49 @@
+package dbsync
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestListUndoRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbsync-undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := OpenUndoJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []UndoEntry{
+		{Side: "Db2", Table: "t", PkCol: "id", Pk: "1", Op: undoInsert, After: map[string]string{"id": "1"}},
+		{Side: "Db2", Table: "t", PkCol: "id", Pk: "2", Op: undoUpdate, Before: map[string]string{"id": "2"},
+			After: map[string]string{"id": "2"}},
+		{Side: "Db2", Table: "t", PkCol: "id", Pk: "3", Op: undoInsert, After: map[string]string{"id": "3"}},
+		{Side: "Db2", Table: "t", PkCol: "id", Pk: "3", Op: undoFailed},
+		{Side: "Db1", Table: "t", PkCol: "id", Pk: "4", Op: undoDelete, Before: map[string]string{"id": "4"}},
+	}
+	for _, entry := range entries {
+		if err := journal.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Close()
+
+	runs, err := ListUndoRuns(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UndoRun{{RunId: journal.RunId, Inserts: 2, Updates: 1, Deletes: 1, Failed: 1}}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("ListUndoRuns = %+v, want %+v", runs, want)
+	}
+
+	read, err := readUndoEntries(dir, journal.RunId)
+	if err != nil || !reflect.DeepEqual(read, entries) {
+		t.Errorf("readUndoEntries = %+v, %v, want %+v", read, err, entries)
+	}
+}
@@ -0,0 +1,146 @@
+package dbsync
+
+import (
+	"../mydb"
+	"../mynodb"
+)
+
+/*
+同步后校验(Verify = true):
+1) 表同步结束后在两边(不使用快照, 读取当前数据)重新计算行数和所有行哈希的BIT_XOR, 分表一边为所有分表的合计
+2) 行数和校验和不一致时再只读比较一次, 统计仍然只在一边存在和不一致的行
+3) 有残留差异的表视为仍不一致, Run返回错误. OneWay模式下只在Db2中存在的行不算差异
+*/
+
+type VerifyResult struct {
+	Count1, Count2 int64
+	Hash1, Hash2   uint64
+	// 校验和不一致时重新比较的结果
+	LeftOnly, RightOnly, Diffs int
+	Diverged                   bool
+}
+
+func (syncParam *tableSync) verify() (*VerifyResult, error) {
+	result := &VerifyResult{}
+	var err error
+	if result.Count1, result.Hash1, err = syncParam.checksum(syncParam.db1, syncParam.tables1); err != nil {
+		return nil, err
+	}
+	if result.Count2, result.Hash2, err = syncParam.checksum(syncParam.db2, syncParam.tables2); err != nil {
+		return nil, err
+	}
+	if result.Count1 == result.Count2 && result.Hash1 == result.Hash2 {
+		return result, nil
+	}
+
+	nodb, err := mynodb.OpenTempStore(syncParam.options.StateBackend)
+	if err != nil {
+		return nil, err
+	}
+	defer nodb.Close()
+
+	options := syncParam.options
+	options.ReadOnly, options.Handler, options.Changelog = true, NopHandler{}, false
+	recheck := &tableSync{
+		ctx:       syncParam.ctx,
+		db1:       syncParam.db1,
+		db2:       syncParam.db2,
+		read1:     syncParam.db1,
+		read2:     syncParam.db2,
+		tableName: syncParam.tableName,
+		nodb:      nodb,
+		state:     syncParam.state,
+		handler:   options.Handler,
+		options:   options,
+		config:    syncParam.config,
+		rowChan1:  make(chan map[string]string),
+		rowChan2:  make(chan map[string]string),
+	}
+	recheck.config.MerkleLeafRows = 0
+	if err := recheck.sync(); err != nil {
+		return nil, err
+	}
+
+	result.LeftOnly, result.RightOnly, result.Diffs = recheck.result.LeftOnly, recheck.result.RightOnly, recheck.result.Diffs
+	result.Diverged = result.LeftOnly > 0 || result.Diffs > 0 || (result.RightOnly > 0 && !options.OneWay)
+	return result, nil
+}
+
+// checksum sums the row counts and xors the row hashes of the tables.
+func (syncParam *tableSync) checksum(db *mydb.Db, side tableSide) (int64, uint64, error) {
+	var count int64
+	var hash uint64
+	for _, table := range side.tables {
+		sql, args, err := table.Select().Expr("count(*)").Expr("coalesce(bit_xor(" + rowHashExpr(table) + "), 0)").Sql()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		rows, err := db.QueryContext(syncParam.ctx, sql, args...)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		node := merkleNode{}
+		if rows.Next() {
+			err = rows.Scan(&node.Count, &node.Hash)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		count, hash = count+node.Count, hash^node.Hash
+	}
+
+	return count, hash, nil
+}
+
+func (syncParam *tableSync) countRows() error {
+	if v := syncParam.result.Verify; v != nil {
+		syncParam.result.Rows1, syncParam.result.Rows2 = v.Count1, v.Count2
+		return nil
+	}
+
+	var err error
+	if syncParam.result.Rows1, err = syncParam.count(syncParam.db1, syncParam.tables1); err != nil {
+		return err
+	}
+	syncParam.result.Rows2, err = syncParam.count(syncParam.db2, syncParam.tables2)
+	return err
+}
+
+// count sums the row counts of the tables.
+func (syncParam *tableSync) count(db *mydb.Db, side tableSide) (int64, error) {
+	var count int64
+	for _, table := range side.tables {
+		sql, args, err := table.Select().Expr("count(*)").Sql()
+		if err != nil {
+			return 0, err
+		}
+
+		rows, err := db.QueryContext(syncParam.ctx, sql, args...)
+		if err != nil {
+			return 0, err
+		}
+
+		var n int64
+		if rows.Next() {
+			err = rows.Scan(&n)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		count += n
+	}
+
+	return count, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"./myconf"
 	"./myutil"
 
 	"log"
@@ -9,7 +10,6 @@ import (
 	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
 	"strings"
 	"os"
-	"github.com/BurntSushi/toml"
 	"strconv"
 )
 
@@ -26,7 +26,7 @@ func ReadConfig() Config {
 	}
 
 	config := Config{}
-	if _, err := toml.DecodeFile(fpath, &config); err != nil {
+	if _, err := myconf.Load(fpath, "BLACKCAT", &config); err != nil {
 		myutil.CheckErr(err)
 	}
 	//fmt.Println(config)
@@ -0,0 +1,220 @@
+package myconf
+
+import (
+	"../myutil"
+	"errors"
+	"github.com/BurntSushi/toml"
+	"github.com/dgiagio/getpass"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+读取toml配置文件:
+1) 环境变量覆盖配置项, 变量名为 前缀_配置项 的大写形式, 例如 DBSYNC_DB1, DBSYNC_TABLES_TR_F_USER_UPDATECOLUMNS,
+   数组用逗号分隔
+2) 解密形如${AES:密文}的值(txtmi加密), 密钥依次取自环境变量CONFIG_AES_KEY、CONFIG_AES_KEY_FILE指定的文件, 或者终端输入
+*/
+
+const (
+	KeyEnv     = "CONFIG_AES_KEY"
+	KeyFileEnv = "CONFIG_AES_KEY_FILE"
+)
+
+var aesRegexp = regexp.MustCompile("\\$\\{AES:(.*?)\\}")
+
+// Load decodes the toml file into the struct pointed by v.
+func Load(fpath, envPrefix string, v interface{}) (toml.MetaData, error) {
+	meta, err := toml.DecodeFile(fpath, v)
+	if err != nil {
+		return meta, err
+	}
+
+	value := reflect.ValueOf(v).Elem()
+	if err := walk(value, strings.ToUpper(envPrefix), overrideEnv); err != nil {
+		return meta, err
+	}
+
+	keys := &keyLoader{}
+	err = walk(value, "", func(v reflect.Value, name string) (bool, error) {
+		if v.Kind() != reflect.String || !aesRegexp.MatchString(v.String()) {
+			return false, nil
+		}
+
+		clear, err := keys.decrypt(v.String())
+		if err != nil {
+			return true, errors.New("myconf: decrypt " + name + ": " + err.Error())
+		}
+
+		v.SetString(clear)
+		return true, nil
+	})
+
+	return meta, err
+}
+
+type keyLoader struct {
+	key string
+}
+
+func (keys *keyLoader) decrypt(s string) (string, error) {
+	if keys.key == "" {
+		key, err := readKey()
+		if err != nil {
+			return "", err
+		}
+		keys.key = myutil.FixStrLength(key, 16)
+	}
+
+	var decryptErr error
+	clear := myutil.ReplaceAllGroupFunc(aesRegexp, s, func(groups []string) string {
+		clear, err := myutil.CBCDecrypt(keys.key, groups[1])
+		if err != nil && decryptErr == nil {
+			decryptErr = err
+		}
+		return clear
+	})
+
+	return clear, decryptErr
+}
+
+func readKey() (string, error) {
+	if key := os.Getenv(KeyEnv); key != "" {
+		return key, nil
+	}
+
+	if keyFile := os.Getenv(KeyFileEnv); keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		return strings.TrimSpace(string(key)), err
+	}
+
+	return getpass.GetPassword("Please input the key: ")
+}
+
+// walk visits the fields of structs and entries of maps and slices, the name
+// is the upper-cased path joined by "_". The children of v are skipped when
+// visit returns true.
+func walk(v reflect.Value, name string, visit func(v reflect.Value, name string) (bool, error)) error {
+	if done, err := visit(v, name); done || err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return walk(v.Elem(), name, visit)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			if err := walk(v.Field(i), joinName(name, fieldName(field)), visit); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// map的值不可寻址, 复制后再写回
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := walk(elem, joinName(name, key.String()), visit); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walk(v.Index(i), name, visit); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func fieldName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("toml"), ",")[0]; tag != "" && tag != "-" {
+		return tag
+	}
+
+	return field.Name
+}
+
+func joinName(prefix, name string) string {
+	name = strings.ToUpper(name)
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "_" + name
+}
+
+func overrideEnv(v reflect.Value, name string) (bool, error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Struct, reflect.Map:
+		return false, nil
+	}
+
+	env, ok := os.LookupEnv(name)
+	if !ok {
+		return false, nil
+	}
+
+	if err := setValue(v, env); err != nil {
+		return true, errors.New("myconf: env " + name + ": " + err.Error())
+	}
+
+	return true, nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		items := myutil.SplitTrim(s, ",")
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	default:
+		return errors.New("unsupported type " + v.Type().String())
+	}
+
+	return nil
+}
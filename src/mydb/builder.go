@@ -0,0 +1,187 @@
+package mydb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Table is a table whose name and columns are read from information_schema,
+// the queries built from it only accept the columns of the table.
+type Table struct {
+	Name    string
+	Columns []string // 按ordinal_position排序
+	Infos   map[string]ColumnInfo
+	dialect Dialect
+}
+
+func (db *Db) Table(ctx context.Context, tableName string) (*Table, error) {
+	infos, err := db.ColumnInfos(ctx, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, errors.New("mydb: table " + tableName + " does not exist")
+	}
+
+	table := &Table{Name: tableName, Infos: make(map[string]ColumnInfo), dialect: db.dialect}
+	for _, info := range infos {
+		table.Columns = append(table.Columns, info.Name)
+		table.Infos[info.Name] = info
+	}
+
+	return table, nil
+}
+
+func (table *Table) HasColumn(col string) bool {
+	for _, column := range table.Columns {
+		if strings.EqualFold(column, col) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (table *Table) CheckColumns(cols ...string) error {
+	for _, col := range cols {
+		if !table.HasColumn(col) {
+			return errors.New("mydb: column " + col + " does not exist in " + table.Name)
+		}
+	}
+
+	return nil
+}
+
+// Quote quotes the column for the raw expressions of Query.Expr.
+func (table *Table) Quote(col string) string {
+	return table.dialect.Quote(col)
+}
+
+var queryOps = map[string]bool{"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// Query builds a select on the table, the first invalid column or operator
+// is reported by Sql.
+type Query struct {
+	table     *Table
+	exprs     []string
+	conds     []string
+	args      []interface{}
+	orderBy   []string
+	limit     int
+	offset    int
+	forUpdate bool
+	err       error
+}
+
+// Select selects the columns, or all the columns when none is given.
+func (table *Table) Select(columns ...string) *Query {
+	query := &Query{table: table}
+	for _, col := range columns {
+		query.exprs = append(query.exprs, query.column(col))
+	}
+
+	return query
+}
+
+// Expr adds a select expression as is, the columns in it should be quoted
+// by Table.Quote.
+func (query *Query) Expr(expr string) *Query {
+	query.exprs = append(query.exprs, expr)
+	return query
+}
+
+// Where adds "col op ?", the conditions are joined by and.
+func (query *Query) Where(col, op string, arg interface{}) *Query {
+	if !queryOps[op] && query.err == nil {
+		query.err = errors.New("mydb: unsupported operator " + op)
+	}
+
+	query.conds = append(query.conds, query.column(col)+" "+op+" ?")
+	query.args = append(query.args, arg)
+	return query
+}
+
+// Cond adds a raw condition like "(a > ? or (a = ? and b > ?))", the columns
+// in it should be quoted by Table.Quote.
+func (query *Query) Cond(cond string, args ...interface{}) *Query {
+	query.conds = append(query.conds, cond)
+	query.args = append(query.args, args...)
+	return query
+}
+
+// In adds "col in (?, ...)", no arg matches no row.
+func (query *Query) In(col string, args ...interface{}) *Query {
+	if len(args) == 0 {
+		query.conds = append(query.conds, "1 = 0")
+		return query
+	}
+
+	query.conds = append(query.conds, query.column(col)+" in (?"+strings.Repeat(", ?", len(args)-1)+")")
+	query.args = append(query.args, args...)
+	return query
+}
+
+func (query *Query) OrderBy(columns ...string) *Query {
+	for _, col := range columns {
+		query.orderBy = append(query.orderBy, query.column(col))
+	}
+
+	return query
+}
+
+func (query *Query) Limit(limit int) *Query {
+	query.limit = limit
+	return query
+}
+
+func (query *Query) Offset(offset int) *Query {
+	query.offset = offset
+	return query
+}
+
+// ForUpdate locks the selected rows until the transaction ends, SQLite
+// locks the database for a write transaction and does not need it.
+func (query *Query) ForUpdate() *Query {
+	query.forUpdate = true
+	return query
+}
+
+func (query *Query) column(col string) string {
+	if query.err == nil {
+		query.err = query.table.CheckColumns(col)
+	}
+
+	return query.table.Quote(col)
+}
+
+func (query *Query) Sql() (string, []interface{}, error) {
+	if query.err != nil {
+		return "", nil, query.err
+	}
+
+	exprs := "*"
+	if len(query.exprs) > 0 {
+		exprs = strings.Join(query.exprs, ", ")
+	}
+
+	sql := "select " + exprs + " from " + query.table.Quote(query.table.Name)
+	if len(query.conds) > 0 {
+		sql += " where " + strings.Join(query.conds, " and ")
+	}
+	if len(query.orderBy) > 0 {
+		sql += " order by " + strings.Join(query.orderBy, ", ")
+	}
+	if query.limit > 0 {
+		sql += " limit " + strconv.Itoa(query.limit)
+	}
+	if query.offset > 0 {
+		sql += " offset " + strconv.Itoa(query.offset)
+	}
+	if query.forUpdate && query.table.dialect != SQLite {
+		sql += " for update"
+	}
+
+	return sql, query.args, nil
+}
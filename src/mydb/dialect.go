@@ -0,0 +1,78 @@
+package mydb
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Dialect string
+
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite3"
+)
+
+// Quote quotes the identifier, the quote char inside the name is doubled.
+func (dialect Dialect) Quote(name string) string {
+	quote := `"`
+	if dialect == MySQL {
+		quote = "`"
+	}
+
+	return quote + strings.Replace(name, quote, quote+quote, -1) + quote
+}
+
+func (dialect Dialect) quoteAll(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = dialect.Quote(name)
+	}
+
+	return quoted
+}
+
+// Rebind replaces the ? placeholders for the dialects which use $1, $2...
+func (dialect Dialect) Rebind(sql string) string {
+	if dialect != Postgres {
+		return sql
+	}
+
+	parts := strings.Split(sql, "?")
+	result := parts[0]
+	for i, part := range parts[1:] {
+		result += "$" + strconv.Itoa(i+1) + part
+	}
+
+	return result
+}
+
+// upsertSql makes an insert which updates updateCols when a row with the
+// same keyCols already exists, or does nothing when updateCols is empty.
+func (dialect Dialect) upsertSql(tableName string, keyCols []string, row map[string]string, updateCols []string) (string, []interface{}) {
+	sql, vals := dialect.insertSql(tableName, row)
+
+	sets := make([]string, 0, len(updateCols))
+	if dialect == MySQL {
+		for _, col := range dialect.quoteAll(updateCols) {
+			sets = append(sets, col+"=values("+col+")")
+		}
+		if len(sets) == 0 {
+			key := dialect.Quote(keyCols[0])
+			sets = append(sets, key+"="+key)
+		}
+
+		return sql + " on duplicate key update " + strings.Join(sets, ","), vals
+	}
+
+	sql += " on conflict(" + strings.Join(dialect.quoteAll(keyCols), ",") + ")"
+	if len(updateCols) == 0 {
+		return sql + " do nothing", vals
+	}
+
+	for _, col := range dialect.quoteAll(updateCols) {
+		sets = append(sets, col+"=excluded."+col)
+	}
+
+	return sql + " do update set " + strings.Join(sets, ","), vals
+}
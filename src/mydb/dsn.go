@@ -0,0 +1,28 @@
+package mydb
+
+import (
+	"net/url"
+	"strings"
+)
+
+// SetDsnParam sets the parameter of a go-sql-driver/mysql data source name
+// when it is not set yet, the unknown parameters are set as session variables
+// of every connection, for example SetDsnParam(dsn, "time_zone", "'+00:00'").
+func SetDsnParam(dataSourceName, name, value string) string {
+	base, query := dataSourceName, ""
+	if i := strings.Index(dataSourceName, "?"); i >= 0 {
+		base, query = dataSourceName[:i], dataSourceName[i+1:]
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil || params.Get(name) != "" {
+		return dataSourceName
+	}
+
+	param := name + "=" + url.QueryEscape(value)
+	if query == "" {
+		return base + "?" + param
+	}
+
+	return base + "?" + query + "&" + param
+}
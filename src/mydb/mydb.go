@@ -2,20 +2,39 @@ package mydb
 
 import (
 	"../myutil"
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
 )
 
 type Db struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect Dialect
 }
 
 func GetDb(dataSourceName string) *Db {
-	db, err := sql.Open("mysql", dataSourceName)
+	db, err := OpenDb(dataSourceName)
 	myutil.CheckErr(err)
 
-	return &Db{db}
+	return db
+}
+
+func OpenDb(dataSourceName string) (*Db, error) {
+	return Open(string(MySQL), dataSourceName)
+}
+
+func Open(driverName, dataSourceName string) (*Db, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Db{db, Dialect(driverName)}, nil
+}
+
+func (db *Db) Dialect() Dialect {
+	return db.dialect
 }
 
 func (db *Db) Close() error {
@@ -28,6 +47,10 @@ func (db *Db) Query(sql string, args ...interface{}) *sql.Rows {
 	return rows
 }
 
+func (db *Db) QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return db.db.QueryContext(ctx, db.dialect.Rebind(sql), args...)
+}
+
 func MakeColumnsValues(rows *sql.Rows) ([]string, [][]byte, []interface{}) {
 	columns, _ := rows.Columns()
 	values := make([][]byte, len(columns))
@@ -40,8 +63,15 @@ func MakeColumnsValues(rows *sql.Rows) ([]string, [][]byte, []interface{}) {
 }
 
 func ScanRow(rows *sql.Rows, columns []string, values [][]byte, scans []interface{}) map[string]string {
+	row, err := ReadRow(rows, columns, values, scans)
+	myutil.CheckErr(err)
+
+	return row
+}
+
+func ReadRow(rows *sql.Rows, columns []string, values [][]byte, scans []interface{}) (map[string]string, error) {
 	if err := rows.Scan(scans...); err != nil {
-		myutil.CheckErr(err)
+		return nil, err
 	}
 
 	row := make(map[string]string)
@@ -54,11 +84,11 @@ func ScanRow(rows *sql.Rows, columns []string, values [][]byte, scans []interfac
 		}
 	}
 
-	return row
+	return row, nil
 }
 
 func (db *Db) InsertRow(tableName string, row map[string]string) int {
-	sql, vals := compositeSql(tableName, row)
+	sql, vals := db.dialect.insertSql(tableName, row)
 	stmt, err := db.db.Prepare(sql)
 	myutil.CheckErr(err)
 
@@ -75,20 +105,108 @@ func (db *Db) InsertRow(tableName string, row map[string]string) int {
 	return int(rowCnt)
 }
 
-func compositeSql(tableName string, row map[string]string) (string, []interface{}) {
+func (db *Db) InsertRowContext(ctx context.Context, tableName string, row map[string]string) (int, error) {
+	sql, vals := db.dialect.insertSql(tableName, row)
+	return db.execContext(ctx, sql, vals)
+}
+
+// InsertRowIdContext inserts the row and returns the generated auto increment id.
+func (db *Db) InsertRowIdContext(ctx context.Context, tableName string, row map[string]string) (int64, error) {
+	sql, vals := db.dialect.insertSql(tableName, row)
+	res, err := db.db.ExecContext(ctx, db.dialect.Rebind(sql), vals...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// UpsertRowContext inserts the row, or updates updateCols of the existing row
+// with the same keyCols.
+func (db *Db) UpsertRowContext(ctx context.Context, tableName string, keyCols []string,
+	row map[string]string, updateCols []string) (int, error) {
+	sql, vals := db.dialect.upsertSql(tableName, keyCols, row, updateCols)
+	return db.execContext(ctx, sql, vals)
+}
+
+// UpdateRowContext updates the row by the primary key, pk is converted by
+// ColumnInfo.Arg for an integer key.
+func (db *Db) UpdateRowContext(ctx context.Context, tableName, pkCol string, pk interface{},
+	row map[string]string) (int, error) {
+	sql, vals := db.dialect.updateSql(tableName, pkCol, pk, row)
+	return db.execContext(ctx, sql, vals)
+}
+
+// DeleteRowContext deletes the row by the primary key, pk is converted by
+// ColumnInfo.Arg for an integer key.
+func (db *Db) DeleteRowContext(ctx context.Context, tableName, pkCol string, pk interface{}) (int, error) {
+	sql, vals := db.dialect.deleteSql(tableName, pkCol, pk)
+	return db.execContext(ctx, sql, vals)
+}
+
+// ExecContext runs a statement like DDL and returns the affected rows.
+func (db *Db) ExecContext(ctx context.Context, sql string, args ...interface{}) (int, error) {
+	return db.execContext(ctx, sql, args)
+}
+
+func (db *Db) execContext(ctx context.Context, sql string, vals []interface{}) (int, error) {
+	return execRows(ctx, db.db, db.dialect, sql, vals)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execRows runs the statement on a Db or Tx and returns the affected rows.
+func execRows(ctx context.Context, e execer, dialect Dialect, sql string, vals []interface{}) (int, error) {
+	res, err := e.ExecContext(ctx, dialect.Rebind(sql), vals...)
+	if err != nil {
+		return 0, err
+	}
+
+	rowCnt, err := res.RowsAffected()
+	return int(rowCnt), err
+}
+
+func (dialect Dialect) updateSql(tableName, pkCol string, pk interface{}, row map[string]string) (string, []interface{}) {
+	sets := make([]string, 0, len(row))
+	vals := make([]interface{}, 0, len(row)+1)
+	for key, val := range row {
+		sets = append(sets, dialect.Quote(key)+" = ?")
+		vals = append(vals, sqlValue(val))
+	}
+
+	sql := "update " + dialect.Quote(tableName) + " set " + strings.Join(sets, ", ") +
+		" where " + dialect.Quote(pkCol) + " = ?"
+	return sql, append(vals, pk)
+}
+
+func (dialect Dialect) deleteSql(tableName, pkCol string, pk interface{}) (string, []interface{}) {
+	sql := "delete from " + dialect.Quote(tableName) + " where " + dialect.Quote(pkCol) + " = ?"
+	return sql, []interface{}{pk}
+}
+
+func (dialect Dialect) deleteKeysSql(tableName string, keyCols []string, row map[string]string) (string, []interface{}) {
+	conds := make([]string, 0, len(keyCols))
+	vals := make([]interface{}, 0, len(keyCols))
+	for _, col := range keyCols {
+		conds = append(conds, dialect.Quote(col)+" = ?")
+		vals = append(vals, sqlValue(row[col]))
+	}
+
+	return "delete from " + dialect.Quote(tableName) + " where " + strings.Join(conds, " and "), vals
+}
+
+func (dialect Dialect) insertSql(tableName string, row map[string]string) (string, []interface{}) {
 	mystr := myutil.MyStr{}
-	mystr.PS("insert into ").PS(tableName).PS("(")
+	mystr.PS("insert into ").PS(dialect.Quote(tableName)).PS("(")
 	vals := make([]interface{}, len(row))
 
 	i := 0
 	for key, val := range row {
-		if val == "NULL" {
-			vals[i] = nil
-		} else {
-			vals[i] = val
-		}
+		vals[i] = sqlValue(val)
 
-		mystr.PS(key).PS(",")
+		mystr.PS(dialect.Quote(key)).PS(",")
 		i++
 	}
 
@@ -98,3 +216,12 @@ func compositeSql(tableName string, row map[string]string) (string, []interface{
 
 	return sql, vals
 }
+
+// sqlValue converts the "NULL" made by ScanRow back to nil.
+func sqlValue(val string) interface{} {
+	if val == "NULL" {
+		return nil
+	}
+
+	return val
+}
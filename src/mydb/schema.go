@@ -0,0 +1,235 @@
+package mydb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+func (db *Db) PingContext(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+func (db *Db) CurrentDatabase(ctx context.Context) (string, error) {
+	var database string
+	err := db.db.QueryRowContext(ctx, "select database()").Scan(&database)
+	return database, err
+}
+
+// Tables lists the base tables of the current database.
+func (db *Db) Tables(ctx context.Context) ([]string, error) {
+	return db.queryStrings(ctx, "select table_name from information_schema.tables "+
+		"where table_schema = database() and table_type = 'BASE TABLE' order by table_name")
+}
+
+// EstimatedRows returns the row count estimated by information_schema.tables.
+func (db *Db) EstimatedRows(ctx context.Context, tableName string) (int64, error) {
+	var rows int64
+	err := db.db.QueryRowContext(ctx, "select coalesce(table_rows, 0) from information_schema.tables "+
+		"where table_schema = database() and table_name = ?", tableName).Scan(&rows)
+	return rows, err
+}
+
+func (db *Db) TableExists(ctx context.Context, tableName string) (bool, error) {
+	count := 0
+	err := db.db.QueryRowContext(ctx, "select count(*) from information_schema.tables "+
+		"where table_schema = database() and table_name = ?", tableName).Scan(&count)
+	return count > 0, err
+}
+
+type ColumnInfo struct {
+	Name       string
+	DataType   string // 小写, 例如timestamp/varchar
+	Charset    string // 非文本列为空
+	Collation  string
+	Unsigned   bool
+	ColumnType string // 完整的列类型, 例如int(10) unsigned/enum('a','b')/bit(3)
+}
+
+// Arg converts the value read as string to the type of the integer column,
+// MySQL compares an integer with a string as doubles, which are not exact
+// over 2^53.
+func (info ColumnInfo) Arg(value string) interface{} {
+	switch info.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		if info.Unsigned {
+			// go-sql-driver不支持最高位为1的uint64参数
+			if v, err := strconv.ParseUint(value, 10, 63); err == nil {
+				return int64(v)
+			}
+		} else if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return v
+		}
+	}
+
+	return value
+}
+
+// ColumnInfos reads the columns in the ordinal order.
+func (db *Db) ColumnInfos(ctx context.Context, tableName string) ([]ColumnInfo, error) {
+	rows, err := db.QueryContext(ctx, "select column_name, lower(data_type), coalesce(character_set_name, ''), "+
+		"coalesce(collation_name, ''), column_type like '%unsigned%', column_type from information_schema.columns "+
+		"where table_schema = database() and table_name = ? order by ordinal_position", tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := make([]ColumnInfo, 0)
+	for rows.Next() {
+		info := ColumnInfo{}
+		if err := rows.Scan(&info.Name, &info.DataType, &info.Charset, &info.Collation, &info.Unsigned, &info.ColumnType); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, rows.Err()
+}
+
+// TimeZone returns the global and session time_zone, and the offset of the
+// session from UTC like "08:00:00".
+func (db *Db) TimeZone(ctx context.Context) (global, session, offset string, err error) {
+	err = db.db.QueryRowContext(ctx, "select @@global.time_zone, @@session.time_zone, "+
+		"cast(timediff(now(), utc_timestamp()) as char)").Scan(&global, &session, &offset)
+	return
+}
+
+func (db *Db) Columns(ctx context.Context, tableName string) ([]string, error) {
+	return db.queryStrings(ctx, "select column_name from information_schema.columns "+
+		"where table_schema = database() and table_name = ? order by ordinal_position", tableName)
+}
+
+// TablesWithColumns lists the tables of the current database which have all
+// the columns.
+func (db *Db) TablesWithColumns(ctx context.Context, cols ...string) ([]string, error) {
+	args := make([]interface{}, 0, len(cols)+1)
+	for _, col := range cols {
+		args = append(args, col)
+	}
+	args = append(args, len(cols))
+
+	return db.queryStrings(ctx, "select table_name from information_schema.columns "+
+		"where table_schema = database() and column_name in (?"+strings.Repeat(", ?", len(cols)-1)+") "+
+		"group by table_name having count(*) = ? order by table_name", args...)
+}
+
+func (db *Db) IsAutoIncrement(ctx context.Context, tableName, col string) (bool, error) {
+	extra, err := db.queryStrings(ctx, "select extra from information_schema.columns "+
+		"where table_schema = database() and table_name = ? and column_name = ?", tableName, col)
+	if err != nil || len(extra) == 0 {
+		return false, err
+	}
+
+	return strings.Contains(strings.ToLower(extra[0]), "auto_increment"), nil
+}
+
+// AutoIncrementColumn returns the auto increment column of the table, or "".
+func (db *Db) AutoIncrementColumn(ctx context.Context, tableName string) (string, error) {
+	cols, err := db.queryStrings(ctx, "select column_name from information_schema.columns "+
+		"where table_schema = database() and table_name = ? and extra like '%auto_increment%'", tableName)
+	if err != nil || len(cols) == 0 {
+		return "", err
+	}
+
+	return cols[0], nil
+}
+
+// HasIndexOn tells whether an index of the table starts with the column.
+func (db *Db) HasIndexOn(ctx context.Context, tableName, col string) (bool, error) {
+	indexes, err := db.queryStrings(ctx, "select index_name from information_schema.statistics "+
+		"where table_schema = database() and table_name = ? and column_name = ? and seq_in_index = 1", tableName, col)
+	return len(indexes) > 0, err
+}
+
+func (db *Db) PrimaryKey(ctx context.Context, tableName string) ([]string, error) {
+	return db.queryStrings(ctx, "select k.column_name from information_schema.table_constraints t "+
+		"join information_schema.key_column_usage k using(constraint_name, table_schema, table_name) "+
+		"where t.constraint_type = 'PRIMARY KEY' and t.table_schema = database() and t.table_name = ? "+
+		"order by k.ordinal_position", tableName)
+}
+
+func (db *Db) Grants(ctx context.Context) ([]string, error) {
+	return db.queryStrings(ctx, "show grants")
+}
+
+var objectNamesSql = map[string]string{
+	"PROCEDURE": "select routine_name from information_schema.routines " +
+		"where routine_schema = database() and routine_type = 'PROCEDURE' order by routine_name",
+	"FUNCTION": "select routine_name from information_schema.routines " +
+		"where routine_schema = database() and routine_type = 'FUNCTION' order by routine_name",
+	"TRIGGER": "select trigger_name from information_schema.triggers " +
+		"where trigger_schema = database() order by trigger_name",
+	"VIEW": "select table_name from information_schema.views " +
+		"where table_schema = database() order by table_name",
+}
+
+// ObjectNames lists the PROCEDURE, FUNCTION, TRIGGER or VIEW objects of the
+// current database.
+func (db *Db) ObjectNames(ctx context.Context, objectType string) ([]string, error) {
+	sql, ok := objectNamesSql[objectType]
+	if !ok {
+		return nil, errors.New("mydb: unknown object type " + objectType)
+	}
+
+	return db.queryStrings(ctx, sql)
+}
+
+// ShowCreate returns the statement of SHOW CREATE, objectType is TABLE or
+// one of the ObjectNames types.
+func (db *Db) ShowCreate(ctx context.Context, objectType, name string) (string, error) {
+	if _, ok := objectNamesSql[objectType]; !ok && objectType != "TABLE" {
+		return "", errors.New("mydb: unknown object type " + objectType)
+	}
+
+	rows, err := db.db.QueryContext(ctx, "show create "+strings.ToLower(objectType)+" "+db.dialect.Quote(name))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, values, scans := MakeColumnsValues(rows)
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("mydb: " + strings.ToLower(objectType) + " " + name + " does not exist")
+	}
+
+	row, err := ReadRow(rows, columns, values, scans)
+	if err != nil {
+		return "", err
+	}
+
+	// 语句在Create Procedure/Create View等列中, 触发器在SQL Original Statement列中
+	for _, col := range columns {
+		if strings.HasPrefix(col, "Create ") || col == "SQL Original Statement" {
+			if row[col] == "NULL" {
+				return "", errors.New("mydb: no privilege to show the definition of " + name)
+			}
+			return row[col], nil
+		}
+	}
+
+	return "", errors.New("mydb: unexpected columns of show create " + strings.Join(columns, ", "))
+}
+
+func (db *Db) queryStrings(ctx context.Context, sql string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+
+	return result, rows.Err()
+}
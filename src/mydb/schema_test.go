@@ -0,0 +1,26 @@
+package mydb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestColumnInfoArg(t *testing.T) {
+	tests := []struct {
+		info  ColumnInfo
+		value string
+		want  interface{}
+	}{
+		{ColumnInfo{DataType: "bigint"}, "9007199254740993", int64(9007199254740993)},
+		{ColumnInfo{DataType: "int"}, "-12", int64(-12)},
+		{ColumnInfo{DataType: "bigint", Unsigned: true}, "9223372036854775807", int64(9223372036854775807)},
+		{ColumnInfo{DataType: "bigint", Unsigned: true}, "18446744073709551615", "18446744073709551615"},
+		{ColumnInfo{DataType: "varchar"}, "007", "007"},
+		{ColumnInfo{DataType: "int"}, "x", "x"},
+	}
+	for _, test := range tests {
+		if got := test.info.Arg(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v Arg(%v) = %#v, want %#v", test.info.DataType, test.value, got, test.want)
+		}
+	}
+}
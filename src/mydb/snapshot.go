@@ -0,0 +1,144 @@
+package mydb
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+type BinlogPos struct {
+	File     string
+	Position int64
+	GtidSet  string
+	Exact    bool // 是否与快照严格一致, 否则为开启快照之后立即读取的位置
+}
+
+func (pos BinlogPos) String() string {
+	if pos.File == "" && pos.GtidSet == "" {
+		return "binlog disabled"
+	}
+
+	s := pos.File + ":" + strconv.FormatInt(pos.Position, 10)
+	if pos.GtidSet != "" {
+		s += " gtid:" + pos.GtidSet
+	}
+	if !pos.Exact {
+		s += " (approximate)"
+	}
+
+	return s
+}
+
+// Snapshot reads in a START TRANSACTION WITH CONSISTENT SNAPSHOT on its own
+// connection, writes should still go through the Db.
+type Snapshot struct {
+	conn    *sql.Conn
+	dialect Dialect
+	Pos     BinlogPos
+}
+
+func (db *Db) BeginSnapshot(ctx context.Context) (*Snapshot, error) {
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{conn: conn, dialect: db.dialect}
+	for _, sql := range []string{
+		"set session transaction isolation level repeatable read",
+		"start transaction with consistent snapshot, read only",
+	} {
+		if _, err := conn.ExecContext(ctx, sql); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if snapshot.Pos, err = snapshot.binlogPos(ctx); err != nil {
+		snapshot.Close()
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (snapshot *Snapshot) QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return snapshot.conn.QueryContext(ctx, snapshot.dialect.Rebind(sql), args...)
+}
+
+func (snapshot *Snapshot) Close() error {
+	snapshot.conn.ExecContext(context.Background(), "commit")
+	return snapshot.conn.Close()
+}
+
+// binlogPos uses the Binlog_snapshot_* status of MariaDB/Percona Server which
+// matches the snapshot, or falls back to the binlog status.
+func (snapshot *Snapshot) binlogPos(ctx context.Context) (BinlogPos, error) {
+	status, err := queryMap(ctx, snapshot.conn, "show status like 'binlog_snapshot_%'", 0, 1)
+	if err != nil {
+		return BinlogPos{}, err
+	}
+
+	if file := status["Binlog_snapshot_file"]; file != "" {
+		position, _ := strconv.ParseInt(status["Binlog_snapshot_position"], 10, 64)
+		return BinlogPos{file, position, status["Binlog_snapshot_gtid_executed"], true}, nil
+	}
+
+	return binlogStatus(ctx, snapshot.conn)
+}
+
+// BinlogStatus returns the current binlog position, the file is empty when
+// the binlog is disabled.
+func (db *Db) BinlogStatus(ctx context.Context) (BinlogPos, error) {
+	return binlogStatus(ctx, db.db)
+}
+
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// binlogStatus reads SHOW BINARY LOG STATUS, or SHOW MASTER STATUS before
+// MySQL 8.2, which is removed in MySQL 8.4.
+func binlogStatus(ctx context.Context, q rowsQuerier) (BinlogPos, error) {
+	status, err := queryMap(ctx, q, "show binary log status", -1, -1)
+	if err != nil {
+		status, err = queryMap(ctx, q, "show master status", -1, -1)
+	}
+	if err != nil {
+		return BinlogPos{}, err
+	}
+
+	position, _ := strconv.ParseInt(status["Position"], 10, 64)
+	gtidSet := strings.Replace(status["Executed_Gtid_Set"], "\n", "", -1)
+	return BinlogPos{status["File"], position, gtidSet, false}, nil
+}
+
+// queryMap reads the rows as key/value pairs from the keyCol and valueCol
+// columns, or reads the first row as column/value pairs when keyCol < 0.
+func queryMap(ctx context.Context, q rowsQuerier, sql string, keyCol, valueCol int) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]string)
+	columns, values, scans := MakeColumnsValues(rows)
+	for rows.Next() {
+		if err := rows.Scan(scans...); err != nil {
+			return nil, err
+		}
+
+		if keyCol < 0 {
+			for i, col := range columns {
+				result[col] = string(values[i])
+			}
+			break
+		}
+
+		result[string(values[keyCol])] = string(values[valueCol])
+	}
+
+	return result, rows.Err()
+}
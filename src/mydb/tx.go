@@ -0,0 +1,78 @@
+package mydb
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Tx writes the rows in a transaction of the Db.
+type Tx struct {
+	tx      *sql.Tx
+	dialect Dialect
+}
+
+func (db *Db) BeginTx(ctx context.Context) (*Tx, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{tx, db.dialect}, nil
+}
+
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// QueryContext reads in the transaction, the rows should be closed before the
+// next statement.
+func (tx *Tx) QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.QueryContext(ctx, tx.dialect.Rebind(sql), args...)
+}
+
+func (tx *Tx) InsertRowContext(ctx context.Context, tableName string, row map[string]string) (int, error) {
+	sql, vals := tx.dialect.insertSql(tableName, row)
+	return execRows(ctx, tx.tx, tx.dialect, sql, vals)
+}
+
+// InsertRowIdContext inserts the row and returns the generated auto increment id.
+func (tx *Tx) InsertRowIdContext(ctx context.Context, tableName string, row map[string]string) (int64, error) {
+	sql, vals := tx.dialect.insertSql(tableName, row)
+	res, err := tx.tx.ExecContext(ctx, tx.dialect.Rebind(sql), vals...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (tx *Tx) UpsertRowContext(ctx context.Context, tableName string, keyCols []string,
+	row map[string]string, updateCols []string) (int, error) {
+	sql, vals := tx.dialect.upsertSql(tableName, keyCols, row, updateCols)
+	return execRows(ctx, tx.tx, tx.dialect, sql, vals)
+}
+
+// UpdateRowContext updates the row by the primary key, pk is converted by
+// ColumnInfo.Arg for an integer key.
+func (tx *Tx) UpdateRowContext(ctx context.Context, tableName, pkCol string, pk interface{},
+	row map[string]string) (int, error) {
+	sql, vals := tx.dialect.updateSql(tableName, pkCol, pk, row)
+	return execRows(ctx, tx.tx, tx.dialect, sql, vals)
+}
+
+// DeleteRowContext deletes the row by the primary key, pk is converted by
+// ColumnInfo.Arg for an integer key.
+func (tx *Tx) DeleteRowContext(ctx context.Context, tableName, pkCol string, pk interface{}) (int, error) {
+	sql, vals := tx.dialect.deleteSql(tableName, pkCol, pk)
+	return execRows(ctx, tx.tx, tx.dialect, sql, vals)
+}
+
+// DeleteKeysContext deletes the row with the same keyCols as row.
+func (tx *Tx) DeleteKeysContext(ctx context.Context, tableName string, keyCols []string, row map[string]string) (int, error) {
+	sql, vals := tx.dialect.deleteKeysSql(tableName, keyCols, row)
+	return execRows(ctx, tx.tx, tx.dialect, sql, vals)
+}
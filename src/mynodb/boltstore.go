@@ -0,0 +1,102 @@
+package mynodb
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var boltBucket = []byte("state")
+
+// BoltStore keeps the state in the B+tree file state.db of the dir.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBolt(dir string) (*BoltStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0644, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db}, nil
+}
+
+func (store *BoltStore) Get(key string) (string, error) {
+	value := ""
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value = string(tx.Bucket(boltBucket).Get([]byte(key)))
+		return nil
+	})
+
+	return value, err
+}
+
+func (store *BoltStore) Set(key, value string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (store *BoltStore) Exists(key string) bool {
+	exists := false
+	store.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltBucket).Get([]byte(key)) != nil
+		return nil
+	})
+
+	return exists
+}
+
+func (store *BoltStore) Delete(key string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// Iterate reads in one read transaction, fn must not write the store.
+func (store *BoltStore) Iterate(prefix string, fn func(key, value string) bool) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := cursor.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = cursor.Next() {
+			if !fn(string(k), string(v)) {
+				break
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *BoltStore) SetBatch(pairs map[string]string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for key, value := range pairs {
+			if err := bucket.Put([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *BoltStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,85 @@
+package mynodb
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type MemStore struct {
+	mutex sync.RWMutex
+	data  map[string]string
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{data: make(map[string]string)}
+}
+
+func (store *MemStore) Get(key string) (string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.data[key], nil
+}
+
+func (store *MemStore) Set(key, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.data[key] = value
+	return nil
+}
+
+func (store *MemStore) Exists(key string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	_, ok := store.data[key]
+	return ok
+}
+
+func (store *MemStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.data, key)
+	return nil
+}
+
+// Iterate works on a copy of the matched pairs, so fn may change the store.
+func (store *MemStore) Iterate(prefix string, fn func(key, value string) bool) error {
+	store.mutex.RLock()
+	keys := make([]string, 0)
+	values := make(map[string]string)
+	for key, value := range store.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			values[key] = value
+		}
+	}
+	store.mutex.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, values[key]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (store *MemStore) SetBatch(pairs map[string]string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for key, value := range pairs {
+		store.data[key] = value
+	}
+
+	return nil
+}
+
+func (store *MemStore) Close() error {
+	return nil
+}
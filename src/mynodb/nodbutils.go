@@ -6,10 +6,14 @@ import (
 	"github.com/lunny/nodb/config"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
+const iterateBatch = 1000
+
 type Nodb struct {
-	db *nodb.DB
+	nodbs *nodb.Nodb
+	db    *nodb.DB
 }
 
 func (db *Nodb) Set(key, value string) error {
@@ -27,6 +31,58 @@ func (db *Nodb) Exists(key string) bool {
 	return value == 1
 }
 
+func (db *Nodb) Delete(key string) error {
+	_, err := db.db.Del([]byte(key))
+	return err
+}
+
+// Iterate scans the keys from the prefix iterateBatch keys at a time.
+func (db *Nodb) Iterate(prefix string, fn func(key, value string) bool) error {
+	start, inclusive := []byte(prefix), true
+	for {
+		keys, err := db.db.Scan(start, iterateBatch, inclusive, "")
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(string(key), prefix) {
+				return nil
+			}
+
+			value, err := db.db.Get(key)
+			if err != nil {
+				return err
+			}
+			if !fn(string(key), string(value)) {
+				return nil
+			}
+		}
+
+		if len(keys) < iterateBatch {
+			return nil
+		}
+		start, inclusive = keys[len(keys)-1], false
+	}
+}
+
+func (db *Nodb) SetBatch(pairs map[string]string) error {
+	kvs := make([]nodb.KVPair, 0, len(pairs))
+	for key, value := range pairs {
+		kvs = append(kvs, nodb.KVPair{Key: []byte(key), Value: []byte(value)})
+	}
+
+	return db.db.MSet(kvs...)
+}
+
+func (db *Nodb) Close() error {
+	if db.nodbs != nil {
+		db.nodbs.Close()
+	}
+
+	return nil
+}
+
 func OpenTemp() (*Nodb, string, error) {
 	cfg := new(config.Config)
 
@@ -38,5 +94,24 @@ func OpenTemp() (*Nodb, string, error) {
 
 	db, err := nodbs.Select(0)
 
-	return &Nodb{db}, cfg.DataDir, err
+	return &Nodb{nodbs, db}, cfg.DataDir, err
+}
+
+// Open opens a persistent nodb in dataDir, which is kept between runs.
+func Open(dataDir string) (*Nodb, error) {
+	cfg := new(config.Config)
+	cfg.DataDir = dataDir
+
+	nodbs, err := nodb.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := nodbs.Select(0)
+	if err != nil {
+		nodbs.Close()
+		return nil, err
+	}
+
+	return &Nodb{nodbs, db}, nil
 }
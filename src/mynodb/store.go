@@ -0,0 +1,79 @@
+package mynodb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	BackendNodb   = "nodb"
+	BackendMemory = "memory" // 只在内存中, 适合小表和测试, 不能持久化
+	BackendBolt   = "bolt"   // 嵌入式B+树文件
+)
+
+// StateStore is the key/value bookkeeping of dbsync and dbreplic, Get returns
+// "" for a missing key.
+type StateStore interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Exists(key string) bool
+	Delete(key string) error
+	// Iterate calls fn with the pairs whose key has the prefix in the key
+	// order, and stops when fn returns false.
+	Iterate(prefix string, fn func(key, value string) bool) error
+	// SetBatch writes the pairs at once.
+	SetBatch(pairs map[string]string) error
+	Close() error
+}
+
+// OpenStore opens the persistent store of the backend in the dir, the memory
+// backend ignores the dir.
+func OpenStore(backend, dir string) (StateStore, error) {
+	switch backend {
+	case "", BackendNodb:
+		return Open(dir)
+	case BackendMemory:
+		return NewMemStore(), nil
+	case BackendBolt:
+		return OpenBolt(dir)
+	}
+
+	return nil, errors.New("mynodb: unknown state backend " + backend)
+}
+
+// OpenTempStore opens a store in a temp dir, which is removed on Close.
+func OpenTempStore(backend string) (StateStore, error) {
+	if backend == BackendMemory {
+		return NewMemStore(), nil
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "nodb")
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := OpenStore(backend, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if bolt, ok := store.(*BoltStore); ok {
+		// 临时库不需要每次提交都刷盘
+		bolt.db.NoSync = true
+	}
+
+	return &tempStore{store, dir}, nil
+}
+
+type tempStore struct {
+	StateStore
+	dir string
+}
+
+func (store *tempStore) Close() error {
+	err := store.StateStore.Close()
+	os.RemoveAll(store.dir)
+	return err
+}